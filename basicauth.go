@@ -0,0 +1,24 @@
+package hiveconnect
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// basicAuthTransport sends the username and password in an Authorization
+// header, so that they never end up in the URL. Requests that carry the auth
+// cookie are sent without them.
+type basicAuthTransport struct {
+	next       http.RoundTripper
+	username   string
+	password   string
+	cookieName string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hasCookie(req, t.cookieName) {
+		return t.next.RoundTrip(req)
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(t.username + ":" + t.password))
+	return t.next.RoundTrip(withHeader(req, "Authorization", "Basic "+credentials))
+}
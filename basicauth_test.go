@@ -0,0 +1,102 @@
+package hiveconnect
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+// authRecorder records the Authorization header and auth cookie of every
+// request, and sets the auth cookie on authenticated ones.
+type authRecorder struct {
+	mu             sync.Mutex
+	authorizations []string
+	cookies        []string
+	authenticate   func(*http.Request) bool
+}
+
+func (s *authRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizations = append(s.authorizations, r.Header.Get("Authorization"))
+	if cookie, err := r.Cookie(DEFAULT_COOKIE_NAME); err == nil {
+		s.cookies = append(s.cookies, cookie.Value)
+		return
+	}
+	s.cookies = append(s.cookies, "")
+	if !s.authenticate(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: DEFAULT_COOKIE_NAME, Value: "session"})
+}
+
+func (s *authRecorder) requests() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.authorizations...), append([]string(nil), s.cookies...)
+}
+
+// httpTestTransport returns an http mode transport to hs2.example.com, which
+// connects to server.
+func httpTestTransport(t *testing.T, server *httptest.Server, configuration *ConnectionConfiguration,
+	auth string) thrift.TTransport {
+	t.Helper()
+	configuration.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	transport, err := httpTransport(configuration, nil, auth, "hs2.example.com", 10001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// sendHTTP posts messages through an http mode transport to server.
+func sendHTTP(t *testing.T, server *httptest.Server, configuration *ConnectionConfiguration, auth string, messages int) error {
+	t.Helper()
+	transport := httpTestTransport(t, server, configuration, auth)
+	defer transport.Close()
+	for i := 0; i < messages; i++ {
+		transport.Write([]byte("message"))
+		if err := transport.Flush(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBasicAuthTransport(t *testing.T) {
+	recorder := &authRecorder{authenticate: func(r *http.Request) bool {
+		username, password, ok := r.BasicAuth()
+		return ok && username == "bob" && password == "p@ss:word" && !strings.Contains(r.RequestURI, "bob")
+	}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	configuration := NewConnectionConfiguration()
+	configuration.Username = "bob"
+	configuration.Password = "p@ss:word"
+	if err := sendHTTP(t, server, configuration, "LDAP", 2); err != nil {
+		t.Fatal(err)
+	}
+	authorizations, cookies := recorder.requests()
+	if len(authorizations) != 2 || authorizations[0] != "Basic Ym9iOnBAc3M6d29yZA==" {
+		t.Errorf("Authorization headers %q", authorizations)
+	}
+	// The cookie replaces the credentials.
+	if authorizations[1] != "" || cookies[1] != "session" {
+		t.Errorf("second request with %q and cookie %q", authorizations[1], cookies[1])
+	}
+
+	configuration.Password = "wrong"
+	if err := sendHTTP(t, server, configuration, "LDAP", 1); err == nil {
+		t.Error("expected the wrong password to be rejected")
+	}
+}
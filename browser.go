@@ -0,0 +1,228 @@
+package hiveconnect
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const SSO_TOKEN_RESPONSE_PORT_HEADER = "X-Hive-Token-Response-Port"
+const SSO_CLIENT_IDENTIFIER_HEADER = "X-Hive-Client-Identifier"
+const DEFAULT_BROWSER_TIMEOUT = 2 * time.Minute
+
+// BrowserOpener shows the SSO login page at url to the user.
+type BrowserOpener func(url string) error
+
+// OpenBrowser opens url with the desktop's default browser.
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// PrintBrowserURL asks the user to open url, for hosts without a browser.
+func PrintBrowserURL(url string) error {
+	_, err := fmt.Fprintf(os.Stderr, "Open the following URL in a browser to log in:\n%s\n", url)
+	return err
+}
+
+// browserSSOTransport implements the browser (SAML) authentication of
+// HiveServer2. A request without a token is sent with the port of a loopback
+// listener, HiveServer2 redirects it to the identity provider, and once the
+// user has logged in the browser posts the token to the listener. Requests
+// are then sent with the token, until HiveServer2 hands out the auth cookie.
+type browserSSOTransport struct {
+	next       http.RoundTripper
+	cookieName string
+	open       BrowserOpener
+	port       int
+	timeout    time.Duration
+	identifier string
+
+	// sso serialises logins, so that concurrent requests open one page.
+	sso   sync.Mutex
+	mu    sync.Mutex
+	token string
+}
+
+func newBrowserSSOTransport(next http.RoundTripper, configuration *ConnectionConfiguration,
+	cookieName string) (*browserSSOTransport, error) {
+	identifier := make([]byte, 16)
+	if _, err := rand.Read(identifier); err != nil {
+		return nil, err
+	}
+	t := &browserSSOTransport{
+		next:       next,
+		cookieName: cookieName,
+		open:       configuration.BrowserOpener,
+		port:       configuration.BrowserResponsePort,
+		timeout:    configuration.BrowserTimeout,
+		identifier: hex.EncodeToString(identifier),
+	}
+	if t.open == nil {
+		t.open = func(url string) error {
+			if OpenBrowser(url) != nil {
+				return PrintBrowserURL(url)
+			}
+			return nil
+		}
+	}
+	if t.timeout == 0 {
+		t.timeout = DEFAULT_BROWSER_TIMEOUT
+	}
+	return t, nil
+}
+
+func (t *browserSSOTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hasCookie(req, t.cookieName) {
+		return t.next.RoundTrip(req)
+	}
+
+	if token := t.cachedToken(); token != "" {
+		resp, err := t.withToken(req, token)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		// The token has expired, log in again.
+		t.setToken(token, "")
+		if req, err = retryRequest(req, resp); req == nil || err != nil {
+			return resp, err
+		}
+	}
+
+	token, err := t.login(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.withToken(req, token)
+}
+
+func (t *browserSSOTransport) withToken(req *http.Request, token string) (*http.Response, error) {
+	req = withHeader(req, "Authorization", "Bearer "+token)
+	req.Header.Set(SSO_CLIENT_IDENTIFIER_HEADER, t.identifier)
+	return t.next.RoundTrip(req)
+}
+
+func (t *browserSSOTransport) cachedToken() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
+}
+
+// setToken replaces old with token, unless another request did so already.
+func (t *browserSSOTransport) setToken(old, token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == old {
+		t.token = token
+	}
+}
+
+// login runs the SSO flow with req, whose body is sent twice, and returns the
+// token.
+func (t *browserSSOTransport) login(req *http.Request) (string, error) {
+	t.sso.Lock()
+	defer t.sso.Unlock()
+	if token := t.cachedToken(); token != "" {
+		return token, nil
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return "", errors.New("browser authentication requires a request body that can be sent again")
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(t.port)))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to listen for the SSO response")
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	ssoReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if ssoReq.Body, err = req.GetBody(); err != nil {
+			return "", err
+		}
+	}
+	ssoReq.Header.Set(SSO_TOKEN_RESPONSE_PORT_HEADER, strconv.Itoa(port))
+	ssoReq.Header.Set(SSO_CLIENT_IDENTIFIER_HEADER, t.identifier)
+	resp, err := t.next.RoundTrip(ssoReq)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusSeeOther || location == "" {
+		return "", errors.Errorf("expected a redirect to the SSO provider, got %s", resp.Status)
+	}
+
+	responses := make(chan ssoResponse, 1)
+	server := &http.Server{Handler: ssoResponseHandler(responses)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	if err = t.open(location); err != nil {
+		return "", errors.Wrap(err, "unable to open the SSO login page")
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	defer cancel()
+	select {
+	case response := <-responses:
+		if response.status != "true" || response.token == "" {
+			return "", errors.Errorf("SSO login failed: %s", response.message)
+		}
+		t.setToken("", response.token)
+		return response.token, nil
+	case <-ctx.Done():
+		return "", errors.Wrap(ctx.Err(), "no SSO response received")
+	}
+}
+
+type ssoResponse struct {
+	token   string
+	status  string
+	message string
+}
+
+// ssoResponseHandler receives the form HiveServer2 makes the browser post
+// once the identity provider has accepted the user.
+func ssoResponseHandler(responses chan<- ssoResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("status") == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		response := ssoResponse{
+			token:   r.PostForm.Get("token"),
+			status:  r.PostForm.Get("status"),
+			message: r.PostForm.Get("message"),
+		}
+		select {
+		case responses <- response:
+		default:
+		}
+		if response.status == "true" {
+			fmt.Fprintln(w, "Login successful. You can close this window.")
+		} else {
+			fmt.Fprintf(w, "Login failed: %s\n", response.message)
+		}
+	})
+}
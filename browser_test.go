@@ -0,0 +1,117 @@
+package hiveconnect
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSSOServer plays HiveServer2 with browser authentication: requests
+// without a token are redirected to the identity provider, and the token
+// posted to the client is accepted from the same client identifier.
+type fakeSSOServer struct {
+	mu         sync.Mutex
+	port       string
+	identifier string
+	requests   int
+}
+
+func (s *fakeSSOServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	body, _ := io.ReadAll(r.Body)
+
+	if port := r.Header.Get(SSO_TOKEN_RESPONSE_PORT_HEADER); port != "" {
+		s.port = port
+		s.identifier = r.Header.Get(SSO_CLIENT_IDENTIFIER_HEADER)
+		http.Redirect(w, r, "https://idp.example.com/login", http.StatusFound)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer sso-token" || s.identifier == "" ||
+		r.Header.Get(SSO_CLIENT_IDENTIFIER_HEADER) != s.identifier {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Write(body)
+}
+
+// postSSOResponse is the browser after the identity provider has accepted
+// the user.
+func (s *fakeSSOServer) postSSOResponse(form url.Values) error {
+	s.mu.Lock()
+	port := s.port
+	s.mu.Unlock()
+	resp, err := http.PostForm("http://localhost:"+port, form)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func newTestBrowserSSOTransport(t *testing.T, open BrowserOpener) *browserSSOTransport {
+	t.Helper()
+	transport, err := newBrowserSSOTransport(http.DefaultTransport, &ConnectionConfiguration{
+		BrowserOpener:  open,
+		BrowserTimeout: 5 * time.Second,
+	}, DEFAULT_COOKIE_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func TestBrowserSSOTransport(t *testing.T) {
+	hs2 := &fakeSSOServer{}
+	server := httptest.NewServer(hs2)
+	defer server.Close()
+
+	var opened string
+	transport := newTestBrowserSSOTransport(t, func(location string) error {
+		opened = location
+		return hs2.postSSOResponse(url.Values{"token": {"sso-token"}, "status": {"true"}})
+	})
+
+	for _, message := range []string{"first", "second"} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/cliservice", strings.NewReader(message))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != message {
+			t.Fatalf("%s: %q", resp.Status, body)
+		}
+	}
+
+	if opened != "https://idp.example.com/login" {
+		t.Errorf("opened %q", opened)
+	}
+	if hs2.identifier != transport.identifier {
+		t.Errorf("the SSO request carried identifier %q, want %q", hs2.identifier, transport.identifier)
+	}
+	// One SSO request and two requests with the token.
+	if hs2.requests != 3 {
+		t.Errorf("%d requests", hs2.requests)
+	}
+}
+
+func TestBrowserSSOTransportLoginFailed(t *testing.T) {
+	hs2 := &fakeSSOServer{}
+	server := httptest.NewServer(hs2)
+	defer server.Close()
+
+	transport := newTestBrowserSSOTransport(t, func(location string) error {
+		return hs2.postSSOResponse(url.Values{"status": {"false"}, "message": {"user denied"}})
+	})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/cliservice", strings.NewReader("message"))
+	if _, err := transport.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "user denied") {
+		t.Fatalf("expected the SSO failure, got %v", err)
+	}
+}
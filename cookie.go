@@ -0,0 +1,125 @@
+package hiveconnect
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+)
+
+const DEFAULT_COOKIE_NAME = "hive.server2.auth"
+
+// cookieTransport keeps the cookies set by HiveServer2 and replays them, so
+// that only the first request of a session has to authenticate. Expiry,
+// Max-Age, Domain, Path and Secure are handled by net/http/cookiejar.
+//
+// A request whose auth cookie is rejected with a 401 is retried once without
+// it, which makes the authenticating transport below send credentials again.
+type cookieTransport struct {
+	next http.RoundTripper
+	jar  *cookiejar.Jar
+	name string
+
+	mu sync.Mutex
+	// rejected is the auth cookie value the server refused. The jar cannot
+	// delete a cookie without knowing its path, so it is skipped instead
+	// until the server sets a new one.
+	rejected string
+}
+
+func newCookieTransport(next http.RoundTripper, name string) *cookieTransport {
+	jar, _ := cookiejar.New(nil)
+	return &cookieTransport{next: next, jar: jar, name: name}
+}
+
+func (t *cookieTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !hasCookie(resp.Request, t.name) {
+		return resp, err
+	}
+
+	retry, err := retryRequest(req, resp)
+	if retry == nil || err != nil {
+		return resp, err
+	}
+	if cookie, err := resp.Request.Cookie(t.name); err == nil {
+		t.mu.Lock()
+		t.rejected = cookie.Value
+		t.mu.Unlock()
+	}
+	return t.send(retry)
+}
+
+// send adds the stored cookies to a copy of req, as the client may share the
+// header of req with later requests.
+func (t *cookieTransport) send(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	rejected := t.rejected
+	t.mu.Unlock()
+
+	if cookies := t.jar.Cookies(req.URL); len(cookies) > 0 {
+		req = req.Clone(req.Context())
+		for _, cookie := range cookies {
+			if cookie.Name == t.name && cookie.Value == rejected {
+				continue
+			}
+			req.AddCookie(cookie)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		t.jar.SetCookies(req.URL, cookies)
+		for _, cookie := range cookies {
+			if cookie.Name == t.name {
+				t.mu.Lock()
+				t.rejected = ""
+				t.mu.Unlock()
+			}
+		}
+	}
+	if resp.Request == nil {
+		resp.Request = req
+	}
+	return resp, nil
+}
+
+// withHeader returns a copy of req with the header key set to value. The
+// request must not be modified, and its header may be shared with later
+// requests.
+func withHeader(req *http.Request, key, value string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set(key, value)
+	return req
+}
+
+func hasCookie(req *http.Request, name string) bool {
+	if req == nil || name == "" {
+		return false
+	}
+	_, err := req.Cookie(name)
+	return err == nil
+}
+
+// retryRequest prepares req to be sent again after resp was rejected. It
+// returns nil when the body cannot be replayed.
+func retryRequest(req *http.Request, resp *http.Response) (*http.Request, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
@@ -0,0 +1,131 @@
+package hiveconnect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// cookieServer accepts its current auth cookie, and otherwise basic auth,
+// which sets a new cookie.
+type cookieServer struct {
+	mu       sync.Mutex
+	current  string
+	secure   bool
+	expire   bool
+	logins   int
+	requests []string
+}
+
+func (s *cookieServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cookie, err := r.Cookie(DEFAULT_COOKIE_NAME)
+	if err == nil {
+		s.requests = append(s.requests, cookie.Value)
+		if cookie.Value != s.current {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if s.expire {
+			http.SetCookie(w, &http.Cookie{Name: DEFAULT_COOKIE_NAME, Value: cookie.Value, MaxAge: -1})
+		}
+		return
+	}
+	s.requests = append(s.requests, "")
+	if username, _, ok := r.BasicAuth(); !ok || username != "bob" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.logins++
+	s.current = fmt.Sprintf("session-%d", s.logins)
+	http.SetCookie(w, &http.Cookie{Name: DEFAULT_COOKIE_NAME, Value: s.current, Secure: s.secure})
+}
+
+func (s *cookieServer) sent() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return s.logins, requests
+}
+
+func TestCookieTransport(t *testing.T) {
+	cookies := &cookieServer{}
+	server := httptest.NewServer(cookies)
+	defer server.Close()
+	configuration := NewConnectionConfiguration()
+	configuration.Username = "bob"
+
+	transport := httpTestTransport(t, server, configuration, "NONE")
+	defer transport.Close()
+	send := func() {
+		t.Helper()
+		transport.Write([]byte("message"))
+		if err := transport.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send()
+	send()
+	if logins, requests := cookies.sent(); logins != 1 || len(requests) != 2 || requests[1] != "session-1" {
+		t.Fatalf("%d logins, cookies %q", logins, requests)
+	}
+
+	// The server forgets the session: the cookie is dropped once and the
+	// request authenticates again.
+	cookies.mu.Lock()
+	cookies.current = ""
+	cookies.mu.Unlock()
+	send()
+	send()
+	if logins, requests := cookies.sent(); logins != 2 || len(requests) != 3 ||
+		requests[0] != "session-1" || requests[1] != "" || requests[2] != "session-2" {
+		t.Errorf("%d logins, cookies %q", logins, requests)
+	}
+}
+
+func TestCookieTransportAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     bool
+		secure  bool
+		expire  bool
+		cookies []string
+	}{
+		// A Secure cookie is only sent over HTTPS.
+		{name: "Secure", secure: true, cookies: []string{"", "", ""}},
+		{name: "Secure over TLS", tls: true, secure: true, cookies: []string{"", "session-1", "session-1"}},
+		// Max-Age=0 deletes the cookie after it has been used once.
+		{name: "Max-Age", expire: true, cookies: []string{"", "session-1", ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies := &cookieServer{secure: test.secure, expire: test.expire}
+			configuration := NewConnectionConfiguration()
+			configuration.Username = "bob"
+			server := httptest.NewUnstartedServer(cookies)
+			if test.tls {
+				server.StartTLS()
+				roots := x509.NewCertPool()
+				roots.AddCert(server.Certificate())
+				configuration.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+			} else {
+				server.Start()
+			}
+			defer server.Close()
+			if err := sendHTTP(t, server, configuration, "NONE", 3); err != nil {
+				t.Fatal(err)
+			}
+			if _, requests := cookies.sent(); fmt.Sprint(requests) != fmt.Sprint(test.cookies) {
+				t.Errorf("cookies %q, want %q", requests, test.cookies)
+			}
+		})
+	}
+}
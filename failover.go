@@ -0,0 +1,159 @@
+package hiveconnect
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_PORT = 10000
+
+// hiveServer is an instance to try. configuration overrides the shared one
+// when the instance published its own, see ConnectZookeeper.
+type hiveServer struct {
+	host          string
+	port          int
+	configuration *ConnectionConfiguration
+}
+
+// HostError records why connecting to one HiveServer2 instance failed.
+type HostError struct {
+	Host string
+	Port int
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s: %v", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectError is returned when no HiveServer2 instance could be connected
+// to, with the failure of every instance tried.
+type ConnectError struct {
+	Errors []*HostError
+}
+
+func (e *ConnectError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("unable to connect to any of %d Hive servers: %s", len(e.Errors),
+		strings.Join(messages, "; "))
+}
+
+// Is and As look through the error of every host.
+func (e *ConnectError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ConnectError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connect connects to the first HiveServer2 instance of hosts that accepts
+// the connection. hosts is a comma separated list of host:port, the port
+// defaulting to DEFAULT_PORT. The instances are tried in order, or in random
+// order with ShuffleHosts, each within HostConnectTimeout if set.
+func Connect(ctx context.Context, hosts, auth string,
+	configuration *ConnectionConfiguration) (*Connection, error) {
+	if configuration == nil {
+		configuration = NewConnectionConfiguration()
+	}
+	candidates, err := parseHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	if configuration.ShuffleHosts {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	return connectAny(ctx, candidates, auth, configuration)
+}
+
+func parseHosts(hosts string) ([]hiveServer, error) {
+	var candidates []hiveServer
+	for _, entry := range strings.Split(hosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		candidate, err := parseHostPort(entry, DEFAULT_PORT)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no Hive server host given")
+	}
+	return candidates, nil
+}
+
+// parseHostPort accepts host, host:port, [ipv6] and [ipv6]:port.
+func parseHostPort(entry string, defaultPort int) (hiveServer, error) {
+	host, portString, err := net.SplitHostPort(entry)
+	if err != nil {
+		// No port, which SplitHostPort reports as an error.
+		host = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		if strings.ContainsAny(host, "[]") || strings.HasPrefix(entry, "[") != strings.HasSuffix(entry, "]") ||
+			strings.Count(entry, ":") == 1 {
+			return hiveServer{}, errors.Errorf("invalid Hive server address %s", entry)
+		}
+		return hiveServer{host: host, port: defaultPort}, nil
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return hiveServer{}, errors.Errorf("invalid port in Hive server address %s", entry)
+	}
+	return hiveServer{host: host, port: port}, nil
+}
+
+// connectAny tries candidates in turn and returns the first connection that
+// opens, or a ConnectError.
+func connectAny(ctx context.Context, candidates []hiveServer, auth string,
+	configuration *ConnectionConfiguration) (*Connection, error) {
+	connectErr := &ConnectError{}
+	for _, candidate := range candidates {
+		if err := ctx.Err(); err != nil {
+			connectErr.Errors = append(connectErr.Errors, &HostError{Host: candidate.host, Port: candidate.port, Err: err})
+			break
+		}
+
+		hctx, cancel := ctx, context.CancelFunc(func() {})
+		if configuration.HostConnectTimeout > 0 {
+			hctx, cancel = context.WithTimeout(ctx, configuration.HostConnectTimeout)
+		}
+		candidateConfiguration := configuration
+		if candidate.configuration != nil {
+			candidateConfiguration = candidate.configuration
+		}
+		conn, err := innerConnect(hctx, candidate.host, candidate.port, auth, candidateConfiguration)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		connectErr.Errors = append(connectErr.Errors, &HostError{Host: candidate.host, Port: candidate.port, Err: err})
+	}
+	return nil, connectErr
+}
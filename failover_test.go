@@ -0,0 +1,165 @@
+package hiveconnect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		hosts string
+		want  []hiveServer
+		ok    bool
+	}{
+		{hosts: "hs2.example.com", want: []hiveServer{{host: "hs2.example.com", port: DEFAULT_PORT}}, ok: true},
+		{
+			hosts: "hs2-a.example.com:10001, hs2-b.example.com",
+			want:  []hiveServer{{host: "hs2-a.example.com", port: 10001}, {host: "hs2-b.example.com", port: DEFAULT_PORT}},
+			ok:    true,
+		},
+		{hosts: "[2001:db8::1]:10001", want: []hiveServer{{host: "2001:db8::1", port: 10001}}, ok: true},
+		{hosts: "[2001:db8::1]", want: []hiveServer{{host: "2001:db8::1", port: DEFAULT_PORT}}, ok: true},
+		{hosts: "2001:db8::1", want: []hiveServer{{host: "2001:db8::1", port: DEFAULT_PORT}}, ok: true},
+		{hosts: ",hs2.example.com,,", want: []hiveServer{{host: "hs2.example.com", port: DEFAULT_PORT}}, ok: true},
+		{hosts: ""},
+		{hosts: " , "},
+		{hosts: "hs2.example.com:port"},
+		{hosts: "hs2.example.com:0"},
+		{hosts: "hs2.example.com:65536"},
+		{hosts: "[2001:db8::1"},
+		{hosts: "hs2.example.com:"},
+	}
+	for _, test := range tests {
+		candidates, err := parseHosts(test.hosts)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: %v", test.hosts, err)
+			continue
+		}
+		if len(candidates) != len(test.want) {
+			t.Errorf("%q: %+v", test.hosts, candidates)
+			continue
+		}
+		for i, candidate := range candidates {
+			if candidate != test.want[i] {
+				t.Errorf("%q: %+v, want %+v", test.hosts, candidate, test.want[i])
+			}
+		}
+	}
+}
+
+// serveOpenSession answers an OpenSession request on conn with an empty
+// result.
+func serveOpenSession(conn net.Conn) error {
+	defer conn.Close()
+	ctx := context.Background()
+	transport := thrift.NewTBufferedTransport(thrift.NewTSocketFromConnConf(conn, nil), 4096)
+	protocol := thrift.NewTBinaryProtocolConf(transport, nil)
+	name, _, seqID, err := protocol.ReadMessageBegin(ctx)
+	if err != nil {
+		return err
+	}
+	if err = protocol.Skip(ctx, thrift.STRUCT); err != nil {
+		return err
+	}
+	if err = protocol.ReadMessageEnd(ctx); err != nil {
+		return err
+	}
+	if name != "OpenSession" {
+		return errors.New("unexpected call " + name)
+	}
+	protocol.WriteMessageBegin(ctx, name, thrift.REPLY, seqID)
+	protocol.WriteStructBegin(ctx, "OpenSession_result")
+	protocol.WriteFieldStop(ctx)
+	protocol.WriteStructEnd(ctx)
+	protocol.WriteMessageEnd(ctx)
+	return protocol.Flush(ctx)
+}
+
+// failoverConfiguration dials hosts named down, which refuse the connection,
+// slow, which never answer, and up, which accept the session.
+func failoverConfiguration(t *testing.T) (*ConnectionConfiguration, *[]string) {
+	t.Helper()
+	var dialed []string
+	configuration := NewConnectionConfiguration()
+	configuration.Username = "bob"
+	configuration.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		dialed = append(dialed, host)
+		switch host {
+		case "down":
+			return nil, errors.New("connection refused")
+		case "slow":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		go func() {
+			if err := serveOpenSession(server); err != nil {
+				t.Errorf("server: %v", err)
+			}
+		}()
+		return client, nil
+	}
+	return configuration, &dialed
+}
+
+func TestConnectAnyFailover(t *testing.T) {
+	configuration, dialed := failoverConfiguration(t)
+	candidates := []hiveServer{{host: "down", port: 10000}, {host: "up", port: 10001}}
+	conn, err := connectAny(context.Background(), candidates, "NOSASL", configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.host != "up" || conn.port != 10001 {
+		t.Errorf("connected to %s:%d", conn.host, conn.port)
+	}
+	if len(*dialed) != 2 {
+		t.Errorf("dialed %q", *dialed)
+	}
+}
+
+func TestConnectAnyHostTimeout(t *testing.T) {
+	configuration, dialed := failoverConfiguration(t)
+	configuration.HostConnectTimeout = 50 * time.Millisecond
+	candidates := []hiveServer{{host: "slow", port: 10000}, {host: "up", port: 10000}}
+	start := time.Now()
+	conn, err := connectAny(context.Background(), candidates, "NOSASL", configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.host != "up" || len(*dialed) != 2 {
+		t.Errorf("connected to %s after dialing %q", conn.host, *dialed)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the slow host took %v", elapsed)
+	}
+}
+
+func TestConnectAnyAllFail(t *testing.T) {
+	configuration, _ := failoverConfiguration(t)
+	configuration.HostConnectTimeout = 50 * time.Millisecond
+	candidates := []hiveServer{{host: "down", port: 10000}, {host: "slow", port: 10001}}
+	_, err := connectAny(context.Background(), candidates, "NOSASL", configuration)
+
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || len(connectErr.Errors) != 2 {
+		t.Fatalf("expected a ConnectError for both hosts, got %v", err)
+	}
+	if connectErr.Errors[0].Host != "down" || connectErr.Errors[1].Host != "slow" || connectErr.Errors[1].Port != 10001 {
+		t.Errorf("host errors %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("the timeout of the slow host is not matched")
+	}
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Host != "down" {
+		t.Errorf("HostError %+v", hostErr)
+	}
+}
@@ -0,0 +1,223 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// The JKS format is not documented, this follows the Sun implementation:
+//
+//	magic, version, entry count
+//	per entry: tag, alias, timestamp, then
+//	  trusted certificate: certificate
+//	  private key: encrypted PKCS#8 key, certificate chain
+//	SHA-1 over the password, "Mighty Aphrodite" and everything above
+const JKS_MAGIC = 0xfeedfeed
+
+const (
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+)
+
+// The OID of the key protection algorithm of the Sun JKS provider.
+var jksKeyProtectorOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+type jksPrivateKey struct {
+	alias string
+	// protected is the encrypted PKCS#8 key, which is only recovered when
+	// needed, as a truststore does not need the key passwords.
+	protected []byte
+	chain     []*x509.Certificate
+}
+
+// recover decrypts the PKCS#8 key.
+func (k jksPrivateKey) recover(password string) ([]byte, error) {
+	key, err := jksRecoverKey(k.protected, jksPassword(password))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to recover the key %s", k.alias)
+	}
+	return key, nil
+}
+
+type jksKeyStore struct {
+	trustedCerts []*x509.Certificate
+	privateKeys  []jksPrivateKey
+}
+
+type jksReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *jksReader) uint16() uint16 {
+	var v uint16
+	r.read(&v)
+	return v
+}
+
+func (r *jksReader) uint32() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *jksReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *jksReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+// utf reads a string written by DataOutputStream.writeUTF.
+func (r *jksReader) utf() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func (r *jksReader) certificate(version uint32) *x509.Certificate {
+	if version == 2 {
+		if certType := r.utf(); r.err == nil && certType != "X.509" {
+			r.err = errors.Errorf("unsupported certificate type %s", certType)
+		}
+	}
+	der := r.bytes(int(r.uint32()))
+	if r.err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		r.err = err
+	}
+	return cert
+}
+
+// parseJKS decodes a JKS keystore. The integrity of the file is only checked
+// when a password is given, like keytool does.
+func parseJKS(data []byte, password string) (*jksKeyStore, error) {
+	if len(data) < sha1.Size {
+		return nil, errors.New("invalid JKS keystore")
+	}
+	passwordBytes := jksPassword(password)
+	body := data[:len(data)-sha1.Size]
+	if password != "" {
+		digest := sha1.New()
+		digest.Write(passwordBytes)
+		digest.Write([]byte("Mighty Aphrodite"))
+		digest.Write(body)
+		if subtle.ConstantTimeCompare(digest.Sum(nil), data[len(body):]) != 1 {
+			return nil, errors.New("JKS keystore was tampered with, or the password is incorrect")
+		}
+	}
+
+	r := &jksReader{r: bytes.NewReader(body)}
+	if magic := r.uint32(); r.err == nil && magic != JKS_MAGIC {
+		return nil, errors.New("not a JKS keystore")
+	}
+	version := r.uint32()
+	if r.err == nil && version != 1 && version != 2 {
+		return nil, errors.Errorf("unsupported JKS version %d", version)
+	}
+
+	store := &jksKeyStore{}
+	for count := r.uint32(); r.err == nil && count > 0; count-- {
+		tag := r.uint32()
+		alias := r.utf()
+		r.bytes(8) // timestamp
+		switch {
+		case r.err != nil:
+		case tag == jksTrustedCertTag:
+			if cert := r.certificate(version); r.err == nil {
+				store.trustedCerts = append(store.trustedCerts, cert)
+			}
+		case tag == jksPrivateKeyTag:
+			protected := r.bytes(int(r.uint32()))
+			var chain []*x509.Certificate
+			for n := r.uint32(); r.err == nil && n > 0; n-- {
+				if cert := r.certificate(version); r.err == nil {
+					chain = append(chain, cert)
+				}
+			}
+			if r.err == nil {
+				store.privateKeys = append(store.privateKeys, jksPrivateKey{alias: alias, protected: protected, chain: chain})
+			}
+		default:
+			r.err = errors.Errorf("unsupported JKS entry type %d", tag)
+		}
+	}
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "invalid JKS keystore")
+	}
+	return store, nil
+}
+
+// jksRecoverKey decrypts a key protected by the Sun key protector: a salt,
+// the key XORed with a SHA-1 based keystream, and a check digest.
+func jksRecoverKey(protected, password []byte) ([]byte, error) {
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Data      []byte
+	}
+	if _, err := asn1.Unmarshal(protected, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(jksKeyProtectorOID) {
+		return nil, errors.Errorf("unsupported key protection %s", info.Algorithm.Algorithm)
+	}
+	if len(info.Data) < 2*sha1.Size {
+		return nil, errors.New("protected key is too short")
+	}
+
+	salt := info.Data[:sha1.Size]
+	encrypted := info.Data[sha1.Size : len(info.Data)-sha1.Size]
+	check := info.Data[len(info.Data)-sha1.Size:]
+
+	key := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(key); i += sha1.Size {
+		h := sha1.New()
+		h.Write(password)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(key); j++ {
+			key[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(password)
+	h.Write(key)
+	if subtle.ConstantTimeCompare(h.Sum(nil), check) != 1 {
+		return nil, errors.New("incorrect password")
+	}
+	return key, nil
+}
+
+// jksPassword encodes password as UTF-16BE, as Java hashes its chars.
+func jksPassword(password string) []byte {
+	chars := utf16.Encode([]rune(password))
+	b := make([]byte, 2*len(chars))
+	for i, c := range chars {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
@@ -0,0 +1,189 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, name string) (*x509.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pkcs8
+}
+
+// jksProtectKey is the inverse of jksRecoverKey.
+func jksProtectKey(t *testing.T, key []byte, password string) []byte {
+	t.Helper()
+	passwordBytes := jksPassword(password)
+	salt := make([]byte, sha1.Size)
+	rand.Read(salt)
+	data := append([]byte{}, salt...)
+	digest := salt
+	for i := 0; i < len(key); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwordBytes)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(key); j++ {
+			data = append(data, key[i+j]^digest[j])
+		}
+	}
+	h := sha1.New()
+	h.Write(passwordBytes)
+	h.Write(key)
+	data = h.Sum(data)
+
+	protected, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Data      []byte
+	}{pkix.AlgorithmIdentifier{Algorithm: jksKeyProtectorOID, Parameters: asn1.NullRawValue}, data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protected
+}
+
+type jksWriter struct {
+	bytes.Buffer
+	count uint32
+}
+
+func (w *jksWriter) utf(s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *jksWriter) certificate(cert *x509.Certificate) {
+	w.utf("X.509")
+	binary.Write(w, binary.BigEndian, uint32(len(cert.Raw)))
+	w.Write(cert.Raw)
+}
+
+func (w *jksWriter) entry(tag uint32, alias string) {
+	w.count++
+	binary.Write(w, binary.BigEndian, tag)
+	w.utf(alias)
+	binary.Write(w, binary.BigEndian, uint64(0))
+}
+
+func (w *jksWriter) trustedCert(alias string, cert *x509.Certificate) {
+	w.entry(jksTrustedCertTag, alias)
+	w.certificate(cert)
+}
+
+func (w *jksWriter) privateKey(alias string, protected []byte, chain ...*x509.Certificate) {
+	w.entry(jksPrivateKeyTag, alias)
+	binary.Write(w, binary.BigEndian, uint32(len(protected)))
+	w.Write(protected)
+	binary.Write(w, binary.BigEndian, uint32(len(chain)))
+	for _, cert := range chain {
+		w.certificate(cert)
+	}
+}
+
+// keystore returns the keystore with its header and integrity digest.
+func (w *jksWriter) keystore(password string) []byte {
+	var store bytes.Buffer
+	binary.Write(&store, binary.BigEndian, []uint32{JKS_MAGIC, 2, w.count})
+	store.Write(w.Bytes())
+	digest := sha1.New()
+	digest.Write(jksPassword(password))
+	digest.Write([]byte("Mighty Aphrodite"))
+	digest.Write(store.Bytes())
+	return digest.Sum(store.Bytes())
+}
+
+func writeJKS(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "store.jks")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJKSKeyStore(t *testing.T) {
+	cert, key := testCertificate(t, "client")
+	var w jksWriter
+	w.privateKey("client", jksProtectKey(t, key, "changeit"), cert)
+	path := writeJKS(t, w.keystore("changeit"))
+
+	certificate, err := loadKeyStore(path, KEYSTORE_TYPE_JKS, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Leaf.Equal(cert) || certificate.PrivateKey == nil {
+		t.Error("unexpected certificate")
+	}
+
+	if _, err := loadKeyStore(path, KEYSTORE_TYPE_JKS, "wrong"); err == nil {
+		t.Error("expected the wrong password to be rejected")
+	}
+}
+
+// A truststore holding a key under another password is usable without it.
+func TestLoadJKSTrustStoreWithKey(t *testing.T) {
+	ca, _ := testCertificate(t, "ca")
+	cert, key := testCertificate(t, "server")
+	var w jksWriter
+	w.trustedCert("ca", ca)
+	w.privateKey("server", jksProtectKey(t, key, "key-password"), cert)
+	path := writeJKS(t, w.keystore("changeit"))
+
+	certs, err := loadTrustStore(path, KEYSTORE_TYPE_JKS, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(ca) || !certs[1].Equal(cert) {
+		t.Errorf("loaded %d certificates", len(certs))
+	}
+
+	if _, err := loadKeyStore(path, KEYSTORE_TYPE_JKS, "changeit"); err == nil {
+		t.Error("expected the key to need its own password")
+	}
+}
+
+func TestParseJKSTampered(t *testing.T) {
+	ca, _ := testCertificate(t, "ca")
+	var w jksWriter
+	w.trustedCert("ca", ca)
+	data := w.keystore("changeit")
+	data[20] ^= 0xff
+
+	if _, err := parseJKS(data, "changeit"); err == nil {
+		t.Error("expected the tampered keystore to be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+package hiveconnect
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JWTTokenFunc returns the token to send with JWT authentication. It is
+// called for every request that is not authenticated by a cookie, so it
+// should cache the token until it is about to expire.
+type JWTTokenFunc func(ctx context.Context) (string, error)
+
+// jwtTokenSource picks the token source configured on configuration. A
+// callback wins over a file, which wins over a static token.
+func jwtTokenSource(configuration *ConnectionConfiguration) (JWTTokenFunc, error) {
+	switch {
+	case configuration.JWTTokenFunc != nil:
+		return configuration.JWTTokenFunc, nil
+	case configuration.JWTTokenFile != "":
+		return (&jwtTokenFile{path: configuration.JWTTokenFile}).token, nil
+	case configuration.JWTToken != "":
+		token := configuration.JWTToken
+		return func(context.Context) (string, error) { return token, nil }, nil
+	}
+	return nil, errors.New("JWT authentication requires JWTToken, JWTTokenFile or JWTTokenFunc")
+}
+
+// jwtTokenFile reads a token from a file, reading it again whenever the file
+// changes so that a rotated token is picked up.
+type jwtTokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	cached  string
+}
+
+func (f *jwtTokenFile) token(context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read the JWT token file")
+	}
+	if f.cached != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.cached, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read the JWT token file")
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.Errorf("the JWT token file %s is empty", f.path)
+	}
+	f.cached, f.modTime, f.size = token, info.ModTime(), info.Size()
+	return token, nil
+}
+
+// bearerTransport sends the JWT token in an Authorization header. Requests
+// that carry the auth cookie are sent as they are. A 401 is retried once if
+// the token has been rotated in the meantime.
+type bearerTransport struct {
+	next       http.RoundTripper
+	token      JWTTokenFunc
+	cookieName string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hasCookie(req, t.cookieName) {
+		return t.next.RoundTrip(req)
+	}
+
+	token, err := t.token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.roundTrip(req, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	refreshed, err := t.token(req.Context())
+	if err != nil || refreshed == token {
+		return resp, nil
+	}
+	retry, err := retryRequest(req, resp)
+	if retry == nil || err != nil {
+		return resp, err
+	}
+	return t.roundTrip(retry, refreshed)
+}
+
+func (t *bearerTransport) roundTrip(req *http.Request, token string) (*http.Response, error) {
+	return t.next.RoundTrip(withHeader(req, "Authorization", "Bearer "+token))
+}
@@ -0,0 +1,99 @@
+package hiveconnect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBearerTransport(t *testing.T) {
+	recorder := &authRecorder{authenticate: func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer new-token"
+	}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	// The token is rotated after the first request.
+	var mu sync.Mutex
+	calls := 0
+	configuration := NewConnectionConfiguration()
+	configuration.JWTTokenFunc = func(context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return "old-token", nil
+		}
+		return "new-token", nil
+	}
+	if err := sendHTTP(t, server, configuration, "JWT", 2); err != nil {
+		t.Fatal(err)
+	}
+	authorizations, cookies := recorder.requests()
+	if len(authorizations) != 3 || authorizations[0] != "Bearer old-token" || authorizations[1] != "Bearer new-token" {
+		t.Fatalf("Authorization headers %q", authorizations)
+	}
+	if authorizations[2] != "" || cookies[2] != "session" {
+		t.Errorf("third request with %q and cookie %q", authorizations[2], cookies[2])
+	}
+}
+
+func TestBearerTransportRejectedToken(t *testing.T) {
+	recorder := &authRecorder{authenticate: func(*http.Request) bool { return false }}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	configuration := NewConnectionConfiguration()
+	configuration.JWTToken = "static-token"
+	if err := sendHTTP(t, server, configuration, "JWT", 1); err == nil {
+		t.Fatal("expected the token to be rejected")
+	}
+	// An unchanged token is not retried.
+	if authorizations, _ := recorder.requests(); len(authorizations) != 1 || authorizations[0] != "Bearer static-token" {
+		t.Errorf("Authorization headers %q", authorizations)
+	}
+}
+
+func TestJWTTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configuration := NewConnectionConfiguration()
+	configuration.JWTTokenFile = path
+	configuration.JWTToken = "ignored"
+	token, err := jwtTokenSource(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := token(context.Background()); err != nil || got != "first-token" {
+		t.Fatalf("token %q, %v", got, err)
+	}
+
+	if err := os.WriteFile(path, []byte("rotated-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := token(context.Background()); err != nil || got != "rotated-token" {
+		t.Errorf("token %q, %v after rotation", got, err)
+	}
+
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token(context.Background()); err == nil {
+		t.Error("expected an empty token file to be rejected")
+	}
+
+	if _, err := jwtTokenSource(NewConnectionConfiguration()); err == nil {
+		t.Error("expected a missing token to be rejected")
+	}
+}
@@ -0,0 +1,185 @@
+package hiveconnect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	KEYSTORE_TYPE_JKS    = "JKS"
+	KEYSTORE_TYPE_PKCS12 = "PKCS12"
+	KEYSTORE_TYPE_PEM    = "PEM"
+)
+
+// buildTLSConfig adds the truststore, keystore and verification settings of
+// configuration to a copy of its TLSConfig. It returns TLSConfig as it is when
+// none is set.
+func buildTLSConfig(configuration *ConnectionConfiguration) (*tls.Config, error) {
+	if configuration.SSLTrustStore == "" && configuration.SSLKeyStore == "" &&
+		configuration.TLSServerName == "" && len(configuration.TLSPins) == 0 &&
+		!configuration.DisableHostnameVerification {
+		return configuration.TLSConfig, nil
+	}
+
+	if configuration.TLSConfig == nil && configuration.SSLTrustStore == "" && configuration.SSLKeyStore == "" {
+		return nil, errors.New("TLSServerName, TLSPins and DisableHostnameVerification require TLSConfig or SSLTrustStore")
+	}
+
+	tlsConfig := &tls.Config{}
+	if configuration.TLSConfig != nil {
+		tlsConfig = configuration.TLSConfig.Clone()
+	}
+	if configuration.SSLTrustStore != "" {
+		certs, err := loadTrustStore(configuration.SSLTrustStore,
+			keyStoreType(configuration.SSLTrustStore, configuration.TrustStoreType),
+			configuration.TrustStorePassword)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load the truststore %s", configuration.SSLTrustStore)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			tlsConfig.RootCAs.AddCert(cert)
+		}
+	}
+	if configuration.SSLKeyStore != "" {
+		certificate, err := loadKeyStore(configuration.SSLKeyStore,
+			keyStoreType(configuration.SSLKeyStore, configuration.KeyStoreType),
+			configuration.KeyStorePassword)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load the keystore %s", configuration.SSLKeyStore)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+	if err := configureVerification(tlsConfig, configuration); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// keyStoreType defaults to the type implied by the file extension, and JKS
+// otherwise like Java does.
+func keyStoreType(path, storeType string) string {
+	if storeType != "" {
+		return strings.ToUpper(storeType)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pem", ".crt", ".cer":
+		return KEYSTORE_TYPE_PEM
+	case ".p12", ".pfx":
+		return KEYSTORE_TYPE_PKCS12
+	}
+	return KEYSTORE_TYPE_JKS
+}
+
+func loadTrustStore(path, storeType, password string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	switch storeType {
+	case KEYSTORE_TYPE_PEM:
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	case KEYSTORE_TYPE_PKCS12:
+		if certs, err = pkcs12.DecodeTrustStore(data, password); err != nil {
+			// Stores exported by openssl lack the Java trust attribute. Like
+			// with JKS, the certificates of their key entry are trusted.
+			_, leaf, chain, chainErr := pkcs12.DecodeChain(data, password)
+			if chainErr != nil {
+				return nil, err
+			}
+			certs = append([]*x509.Certificate{leaf}, chain...)
+		}
+	case KEYSTORE_TYPE_JKS:
+		store, err := parseJKS(data, password)
+		if err != nil {
+			return nil, err
+		}
+		certs = store.trustedCerts
+		// A keystore can serve as truststore too, Java then trusts the
+		// certificates of its key entries.
+		for _, key := range store.privateKeys {
+			certs = append(certs, key.chain...)
+		}
+	default:
+		return nil, errors.Errorf("unsupported truststore type %s", storeType)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func loadKeyStore(path, storeType, password string) (tls.Certificate, error) {
+	var certificate tls.Certificate
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return certificate, err
+	}
+
+	switch storeType {
+	case KEYSTORE_TYPE_PEM:
+		// The key and its certificate chain in one file.
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+				return certificate, errors.New("encrypted PEM private keys are not supported, use a PKCS12 or JKS keystore")
+			}
+		}
+		return tls.X509KeyPair(data, data)
+	case KEYSTORE_TYPE_PKCS12:
+		key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return certificate, err
+		}
+		certificate.PrivateKey = key
+		certificate.Leaf = leaf
+		certificate.Certificate = [][]byte{leaf.Raw}
+		for _, cert := range chain {
+			certificate.Certificate = append(certificate.Certificate, cert.Raw)
+		}
+	case KEYSTORE_TYPE_JKS:
+		store, err := parseJKS(data, password)
+		if err != nil {
+			return certificate, err
+		}
+		if len(store.privateKeys) != 1 {
+			return certificate, errors.Errorf("expected one private key, found %d", len(store.privateKeys))
+		}
+		entry := store.privateKeys[0]
+		if len(entry.chain) == 0 {
+			return certificate, errors.Errorf("the key %s has no certificate", entry.alias)
+		}
+		key, err := entry.recover(password)
+		if err != nil {
+			return certificate, err
+		}
+		if certificate.PrivateKey, err = x509.ParsePKCS8PrivateKey(key); err != nil {
+			return certificate, err
+		}
+		certificate.Leaf = entry.chain[0]
+		for _, cert := range entry.chain {
+			certificate.Certificate = append(certificate.Certificate, cert.Raw)
+		}
+	default:
+		return certificate, errors.Errorf("unsupported keystore type %s", storeType)
+	}
+	return certificate, nil
+}
@@ -0,0 +1,105 @@
+package hiveconnect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestBuildTLSConfigRequiresTLS(t *testing.T) {
+	for name, configuration := range map[string]*ConnectionConfiguration{
+		"server name": {TLSServerName: "hs2.example.com"},
+		"pins":        {TLSPins: []string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}},
+		"hostname":    {DisableHostnameVerification: true},
+	} {
+		if _, err := buildTLSConfig(configuration); err == nil {
+			t.Errorf("%s: expected an error without TLS", name)
+		}
+	}
+
+	tlsConfig, err := buildTLSConfig(&ConnectionConfiguration{TLSConfig: &tls.Config{}, TLSServerName: "hs2.example.com"})
+	if err != nil || tlsConfig.ServerName != "hs2.example.com" {
+		t.Errorf("%v, %v", tlsConfig, err)
+	}
+	if tlsConfig, err := buildTLSConfig(&ConnectionConfiguration{}); err != nil || tlsConfig != nil {
+		t.Errorf("TLS enabled without configuration: %v, %v", tlsConfig, err)
+	}
+}
+
+func writeStore(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPKCS12TrustStore(t *testing.T) {
+	ca, _ := testCertificate(t, "ca")
+	cert, key := testCertificate(t, "server")
+	privateKey, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustStore, err := pkcs12.Modern.EncodeTrustStore([]*x509.Certificate{ca}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// openssl pkcs12 -export marks no certificate as trusted.
+	keyStore, err := pkcs12.Modern.Encode(privateKey, cert, []*x509.Certificate{ca}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		data []byte
+		want []*x509.Certificate
+	}{
+		"Java":    {data: trustStore, want: []*x509.Certificate{ca}},
+		"openssl": {data: keyStore, want: []*x509.Certificate{cert, ca}},
+	} {
+		path := writeStore(t, "truststore.p12", test.data)
+		certs, err := loadTrustStore(path, keyStoreType(path, ""), "changeit")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(certs) != len(test.want) {
+			t.Fatalf("%s: %d certificates", name, len(certs))
+		}
+		for i, cert := range certs {
+			if !cert.Equal(test.want[i]) {
+				t.Errorf("%s: certificate %d is %s", name, i, cert.Subject)
+			}
+		}
+		if _, err := loadTrustStore(path, KEYSTORE_TYPE_PKCS12, "wrong"); err == nil {
+			t.Errorf("%s: expected the wrong password to be rejected", name)
+		}
+	}
+}
+
+func TestLoadPEMKeyStore(t *testing.T) {
+	cert, key := testCertificate(t, "client")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	path := writeStore(t, "client.pem", append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), certPEM...))
+	if certificate, err := loadKeyStore(path, keyStoreType(path, ""), ""); err != nil || certificate.PrivateKey == nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, block := range map[string]*pem.Block{
+		"PKCS8":    {Type: "ENCRYPTED PRIVATE KEY", Bytes: key},
+		"RFC 1423": {Type: "EC PRIVATE KEY", Headers: map[string]string{"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-256-CBC,00"}, Bytes: key},
+	} {
+		path := writeStore(t, "client.pem", append(pem.EncodeToMemory(block), certPEM...))
+		if _, err := loadKeyStore(path, KEYSTORE_TYPE_PEM, "changeit"); err == nil || !strings.Contains(err.Error(), "encrypted") {
+			t.Errorf("%s: expected the encrypted key to be rejected, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const KNOX_SSO_COOKIE_NAME = "hadoop-jwt"
+
+// knoxTransport is the outermost transport in http mode when a Knox SSO token
+// is configured. It sends the token and turns the redirect to the Knox login
+// page and a rejected token into errors that say what went wrong, where
+// THttpClient would only report the status.
+type knoxTransport struct {
+	next     http.RoundTripper
+	ssoToken string
+}
+
+func (t *knoxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cookie := (&http.Cookie{Name: KNOX_SSO_COOKIE_NAME, Value: t.ssoToken}).String()
+	if cookies := req.Header.Get("Cookie"); cookies != "" {
+		cookie = cookies + "; " + cookie
+	}
+
+	resp, err := t.next.RoundTrip(withHeader(req, "Cookie", cookie))
+	if err != nil {
+		return nil, err
+	}
+	redirect := resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode < http.StatusBadRequest
+	if !redirect && resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if redirect {
+		// Knox sends unauthenticated SSO requests to its login page.
+		return nil, errors.Errorf("redirected to %s, the Knox SSO token may be missing or expired",
+			resp.Header.Get("Location"))
+	}
+	return nil, errors.Errorf("Knox SSO token rejected: %s%s", resp.Status, errorDetail(resp.Body))
+}
+
+// errorDetail returns the start of an error page as a single line.
+func errorDetail(body io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(body, 512))
+	detail := strings.Join(strings.Fields(string(bytes.ToValidUTF8(data, nil))), " ")
+	if detail == "" {
+		return ""
+	}
+	return ": " + detail
+}
@@ -0,0 +1,57 @@
+package hiveconnect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKnoxTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(KNOX_SSO_COOKIE_NAME); err != nil || cookie.Value != "knox-token" {
+			http.Error(w, "missing token", http.StatusBadRequest)
+			return
+		}
+		if _, err := r.Cookie("other"); err != nil {
+			http.Error(w, "missing cookie", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "https://knox.example.com/knoxsso", http.StatusFound)
+		case "/unauthorized":
+			http.Error(w, "token expired", http.StatusUnauthorized)
+		case "/error":
+			http.Error(w, "failure", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	transport := &knoxTransport{next: http.DefaultTransport, ssoToken: "knox-token"}
+	roundTrip := func(path string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		req.Header.Set("Cookie", "other=value")
+		return transport.RoundTrip(req)
+	}
+
+	resp, err := roundTrip("/")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// Other errors are left to THttpClient.
+	resp, err = roundTrip("/error")
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("%v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	if _, err := roundTrip("/redirect"); err == nil || !strings.Contains(err.Error(), "https://knox.example.com/knoxsso") {
+		t.Errorf("expected the redirect to be reported, got %v", err)
+	}
+	if _, err := roundTrip("/unauthorized"); err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("expected the rejected token to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	sasl "github.com/Galzzly/hiveconnect/sasl"
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+func TestSplitServerURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		host string
+		port int
+		ok   bool
+	}{
+		{uri: "hs2.example.com:10000", host: "hs2.example.com", port: 10000, ok: true},
+		{uri: "[2001:db8::1]:10000", host: "2001:db8::1", port: 10000, ok: true},
+		{uri: "2001:db8::1:10001", host: "2001:db8::1", port: 10001, ok: true},
+		{uri: "hs2.example.com"},
+		{uri: "hs2.example.com:port"},
+		{uri: "hs2.example.com:0"},
+		{uri: ":10000"},
+		{uri: ""},
+	}
+	for _, test := range tests {
+		server, ok := splitServerURI(test.uri)
+		if ok != test.ok || ok && (server.host != test.host || server.port != test.port) {
+			t.Errorf("%q: %s:%d, %v", test.uri, server.host, server.port, ok)
+		}
+	}
+}
+
+func TestParseHiveServer2Info(t *testing.T) {
+	const name = "serverUri=hs2.example.com:10000;version=3.1.3;sequence=0000000001"
+	tests := []struct {
+		name    string
+		znode   string
+		data    string
+		host    string
+		port    int
+		mode    string
+		ok      bool
+		applied func(*ConnectionConfiguration) bool
+	}{
+		{name: "name only", znode: name, host: "hs2.example.com", port: 10000, mode: "binary", ok: true},
+		{
+			name: "IPv6 name", znode: "serverUri=[2001:db8::1]:10000;version=3.1.3;sequence=0000000001",
+			host: "2001:db8::1", port: 10000, mode: "binary", ok: true,
+		},
+		{name: "address data", znode: name, data: "hs2-b.example.com:10002\n", host: "hs2-b.example.com", port: 10002, mode: "binary", ok: true},
+		{
+			name: "binary configuration", znode: name,
+			data: "hive.server2.instance.uri=hs2.example.com:10000;hive.server2.transport.mode=binary;" +
+				"hive.server2.thrift.port=10010;hive.server2.thrift.http.port=10011",
+			host: "hs2.example.com", port: 10010, mode: "binary", ok: true,
+		},
+		{
+			name: "http configuration", znode: name,
+			data: "hive.server2.instance.uri=hs2.example.com:10000;hive.server2.transport.mode=http;" +
+				"hive.server2.thrift.port=10010;hive.server2.thrift.http.port=10011;" +
+				"hive.server2.thrift.http.path=gateway;hive.server2.use.SSL=true;" +
+				"hive.server2.authentication.kerberos.principal=hive/_HOST@EXAMPLE.COM;hive.server2.thrift.sasl.qop=auth-conf",
+			host: "hs2.example.com", port: 10011, mode: "http", ok: true,
+			applied: func(c *ConnectionConfiguration) bool {
+				return c.HTTPPath == "gateway" && c.TLSConfig != nil &&
+					c.Principal == "hive/_HOST@EXAMPLE.COM" && c.SaslQop == "auth-conf"
+			},
+		},
+		{
+			name: "both modes", znode: name,
+			data: "hive.server2.instance.uri=hs2.example.com:10000;hive.server2.transport.mode=all;" +
+				"hive.server2.thrift.port=10010;hive.server2.thrift.http.port=10011",
+			host: "hs2.example.com", port: 10010, mode: "binary", ok: true,
+		},
+		{
+			name: "bind host", znode: name,
+			data: "hive.server2.instance.uri=hs2.example.com:10000;hive.server2.thrift.bind.host=10.0.0.1",
+			host: "10.0.0.1", port: 10000, mode: "binary", ok: true,
+		},
+		{name: "bad name", znode: "serverUri=hs2.example.com;sequence=0000000001"},
+		{name: "bad address data", znode: "sequence=0000000001", data: "hs2.example.com:port"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConnectionConfiguration()
+			server, ok := parseHiveServer2Info(test.znode, test.data, configuration)
+			if ok != test.ok {
+				t.Fatalf("ok %v", ok)
+			}
+			if !ok {
+				return
+			}
+			// Servers that publish no configuration use the given one.
+			effective := server.configuration
+			if effective == nil {
+				effective = configuration
+			}
+			if server.host != test.host || server.port != test.port || effective.TransportMode != test.mode {
+				t.Errorf("%s:%d in %s mode", server.host, server.port, effective.TransportMode)
+			}
+			if test.applied != nil && !test.applied(effective) {
+				t.Errorf("the published configuration was not applied: %+v", effective)
+			}
+			if server.configuration == configuration || configuration.TransportMode != "binary" ||
+				configuration.HTTPPath != "cliservice" || configuration.TLSConfig != nil || configuration.Principal != "" {
+				t.Error("the configuration was modified")
+			}
+		})
+	}
+}
+
+func TestTransportUnsupportedAuth(t *testing.T) {
+	configuration := NewConnectionConfiguration()
+	for _, auth := range []string{"NOSASL", "ANONYMOUS", "EXTERNAL", "DIGEST-MD5"} {
+		if _, err := httpTransport(configuration, nil, auth, "hs2.example.com", 10001); err == nil ||
+			!strings.Contains(err.Error(), "http transport mode") {
+			t.Errorf("%s in http mode: %v", auth, err)
+		}
+	}
+	if _, err := binaryTransport(context.Background(), nil, configuration, nil, nil, "OAUTH", "hs2.example.com", 10000); err == nil {
+		t.Error("expected an unsupported authentication error")
+	}
+}
+
+// recordingConn keeps a copy of everything written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+// externalServerMechanism accepts the authorization ID of any client.
+type externalServerMechanism struct {
+	authzid string
+}
+
+func (m *externalServerMechanism) Name() string { return "EXTERNAL" }
+
+func (m *externalServerMechanism) Step(response []byte) ([]byte, bool, error) {
+	m.authzid = string(response)
+	return nil, true, nil
+}
+
+func (m *externalServerMechanism) AuthorizationID() string { return m.authzid }
+
+func TestBinaryTransportProxyUser(t *testing.T) {
+	mechanisms := map[string]sasl.ServerMechanismFactory{
+		"PLAIN": sasl.PlainServerMechanismFactory(func(authzid, username, password string) error {
+			if username != "bob" || password != "secret" {
+				return errors.New("authentication error")
+			}
+			return nil
+		}),
+		"DIGEST-MD5": sasl.DigestMD5ServerMechanismFactory("hive", "EXAMPLE", func(username, realm string) (string, error) {
+			if username != "bob" {
+				return "", errors.New("unknown user")
+			}
+			return "secret", nil
+		}),
+		"EXTERNAL": func() sasl.ServerMechanism { return &externalServerMechanism{} },
+	}
+	tests := []struct {
+		auth string
+		wire string
+	}{
+		{auth: "NONE", wire: "alice\x00bob\x00secret"},
+		{auth: "DIGEST-MD5", wire: `,authzid="alice"`},
+		{auth: "EXTERNAL", wire: "\x02\x00\x00\x00\x05alice"},
+	}
+	for _, test := range tests {
+		t.Run(test.auth, func(t *testing.T) {
+			configuration := NewConnectionConfiguration()
+			configuration.Username = "bob"
+			configuration.Password = "secret"
+			configuration.Service = "hive"
+			configuration.ProxyUser = "alice"
+			configuration.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+
+			clientConn, serverConn := net.Pipe()
+			recorded := &recordingConn{Conn: clientConn}
+			server := sasl.NewTSaslServerTransport(thrift.NewTSocketFromConnConf(serverConn, nil), mechanisms, 1<<20)
+			served := make(chan error, 1)
+			go func() { served <- server.Open() }()
+
+			transport, err := binaryTransport(context.Background(), thrift.NewTSocketFromConnConf(recorded, nil),
+				configuration, nil, nil, test.auth, "hs2.example.com", 10000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+			if err = <-served; err != nil {
+				t.Fatal(err)
+			}
+			if id := server.AuthorizationID(); id != "alice" {
+				t.Errorf("authorization ID %q", id)
+			}
+			if !bytes.Contains(recorded.written.Bytes(), []byte(test.wire)) {
+				t.Errorf("%q not sent in %q", test.wire, recorded.written.Bytes())
+			}
+		})
+	}
+}
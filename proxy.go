@@ -0,0 +1,238 @@
+package hiveconnect
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// NewSOCKS5Dialer dials through the SOCKS5 proxy at address. Host names are
+// resolved by the proxy. username may be empty when the proxy does not
+// require authentication.
+func NewSOCKS5Dialer(address, username, password string) (DialContextFunc, error) {
+	return socks5Dialer(address, username, password, (&net.Dialer{}).DialContext)
+}
+
+func socks5Dialer(address, username, password string, forward DialContextFunc) (DialContextFunc, error) {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", address, auth, forwardDialer(forward))
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext, nil
+}
+
+// forwardDialer lets the SOCKS5 dialer connect to the proxy with a
+// DialContextFunc.
+type forwardDialer DialContextFunc
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// NewHTTPConnectDialer tunnels connections through an HTTP proxy with
+// CONNECT. The proxy URL may use http or https, and carry the credentials
+// sent as Proxy-Authorization.
+func NewHTTPConnectDialer(proxyURL *url.URL) DialContextFunc {
+	return httpConnectDialer(proxyURL, (&net.Dialer{}).DialContext)
+}
+
+func httpConnectDialer(proxyURL *url.URL, forward DialContextFunc) DialContextFunc {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if user := proxyURL.User; user != nil {
+			password, _ := user.Password()
+			req.Header.Set("Proxy-Authorization",
+				"Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+		}
+		if err = req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, errors.Errorf("proxy %s refused to connect to %s: %s", proxyAddr, addr, resp.Status)
+		}
+		if reader.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, reader: reader}, nil
+		}
+		return conn, nil
+	}
+}
+
+// bufferedConn returns what was read past the CONNECT response first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// newProxyDialer supports socks5, socks5h, http and https proxy URLs. The
+// proxy is reached with forward.
+func newProxyDialer(proxyURL *url.URL, forward DialContextFunc) (DialContextFunc, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		password, _ := proxyURL.User.Password()
+		return socks5Dialer(proxyURL.Host, proxyURL.User.Username(), password, forward)
+	case "http", "https":
+		return httpConnectDialer(proxyURL, forward), nil
+	}
+	return nil, errors.Errorf("unsupported proxy scheme %s", proxyURL.Scheme)
+}
+
+// environmentProxyDialer picks the proxy for every address from ALL_PROXY,
+// or else HTTPS_PROXY, and connects directly to the hosts in NO_PROXY.
+func environmentProxyDialer(forward DialContextFunc) DialContextFunc {
+	config := httpproxy.FromEnvironment()
+	for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+		if value := os.Getenv(name); value != "" {
+			config.HTTPSProxy = value
+			break
+		}
+	}
+	proxyFunc := config.ProxyFunc()
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxyURL, err := proxyFunc(&url.URL{Scheme: "https", Host: addr})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return forward(ctx, network, addr)
+		}
+		dial, err := newProxyDialer(proxyURL, forward)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// dialContextFunc returns the DialContext of configuration, or else a dialer
+// for the proxy it sets. It returns nil for direct connections.
+func dialContextFunc(configuration *ConnectionConfiguration) (DialContextFunc, error) {
+	switch {
+	case configuration.DialContext != nil:
+		return configuration.DialContext, nil
+	case configuration.ProxyURL != "":
+		proxyURL, err := url.Parse(configuration.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy URL")
+		}
+		return newProxyDialer(proxyURL, tcpDialer(configuration))
+	case configuration.ProxyFromEnvironment:
+		return environmentProxyDialer(tcpDialer(configuration)), nil
+	}
+	return nil, nil
+}
+
+// zkDialer adapts dial to the ZooKeeper client, replacing its fixed dial
+// timeout with timeout.
+func zkDialer(dial DialContextFunc, timeout time.Duration) func(network, address string, _ time.Duration) (net.Conn, error) {
+	return func(network, address string, _ time.Duration) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
+
+// unresolvedHostProvider hands the ZooKeeper servers to the dialer as they
+// are, as the proxy may be the only one able to resolve them. It otherwise
+// behaves like zk.DNSHostProvider.
+type unresolvedHostProvider struct {
+	mu      sync.Mutex
+	servers []string
+	curr    int
+	last    int
+}
+
+func (p *unresolvedHostProvider) Init(servers []string) error {
+	if len(servers) == 0 {
+		return errors.New("no ZooKeeper servers")
+	}
+	p.servers, p.curr, p.last = servers, -1, -1
+	return nil
+}
+
+func (p *unresolvedHostProvider) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.servers)
+}
+
+func (p *unresolvedHostProvider) Next() (server string, retryStart bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.curr = (p.curr + 1) % len(p.servers)
+	retryStart = p.curr == p.last
+	if p.last == -1 {
+		p.last = 0
+	}
+	return p.servers[p.curr], retryStart
+}
+
+func (p *unresolvedHostProvider) Connected() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = p.curr
+}
@@ -0,0 +1,245 @@
+package hiveconnect
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSOCKS5 accepts one connection, requiring username and password when
+// username is set, and answers the request with reply. On success it writes
+// "hello" to the client.
+func fakeSOCKS5(t *testing.T, username, password string, reply byte) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := serveSOCKS5(conn, username, password, reply, targets); err != nil {
+			t.Errorf("SOCKS5 server: %v", err)
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func serveSOCKS5(conn net.Conn, username, password string, reply byte, targets chan<- string) error {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	method := byte(0)
+	if username != "" {
+		method = 2
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		conn.Write([]byte{5, 0xff})
+		return errors.New("the client did not offer the method")
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 2 {
+		credentials := make([]string, 2)
+		if _, err := r.ReadByte(); err != nil {
+			return err
+		}
+		for i := range credentials {
+			size, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			value := make([]byte, size)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			credentials[i] = string(value)
+		}
+		if credentials[0] != username || credentials[1] != password {
+			conn.Write([]byte{1, 1})
+			return nil
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		host = string(name)
+	default:
+		return errors.New("unexpected address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return err
+	}
+	targets <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	conn.Write([]byte{5, reply, 0, 1, 127, 0, 0, 1, 0, 0})
+	if reply == 0 {
+		conn.Write([]byte("hello"))
+	}
+	return nil
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		dialUser string
+		reply    byte
+		ok       bool
+	}{
+		{name: "no auth", ok: true},
+		{name: "user/pass", username: "bob", password: "secret", dialUser: "bob", ok: true},
+		{name: "bad password", username: "bob", password: "other", dialUser: "bob"},
+		{name: "connection refused", reply: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, targets := fakeSOCKS5(t, test.username, test.password, test.reply)
+			dial, err := NewSOCKS5Dialer(addr, test.dialUser, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial(context.Background(), "tcp", "hs2.example.com:10000")
+			if !test.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected the dial to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// The proxy resolves the host name.
+			if target := <-targets; target != "hs2.example.com:10000" {
+				t.Errorf("proxy connected to %s", target)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Errorf("read %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+// fakeConnectProxy accepts one CONNECT request and answers it with response,
+// in the same write as the first bytes of the tunnel.
+func fakeConnectProxy(t *testing.T, response string) (*url.URL, chan *http.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("proxy: %v", err)
+			return
+		}
+		requests <- req
+		conn.Write([]byte(response))
+	}()
+	return &url.URL{Scheme: "http", User: url.UserPassword("bob", "secret"), Host: listener.Addr().String()}, requests
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	proxyURL, requests := fakeConnectProxy(t, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	conn, err := NewHTTPConnectDialer(proxyURL)(context.Background(), "tcp", "hs2.example.com:10001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "hs2.example.com:10001" {
+		t.Errorf("%s %s", req.Method, req.Host)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic Ym9iOnNlY3JldA==" {
+		t.Errorf("Proxy-Authorization %q", auth)
+	}
+	// The bytes read with the response are not lost.
+	if _, ok := conn.(*bufferedConn); !ok {
+		t.Errorf("%T is not buffered", conn)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
+
+func TestHTTPConnectDialerProxyAuthRequired(t *testing.T) {
+	proxyURL, _ := fakeConnectProxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	_, err := NewHTTPConnectDialer(proxyURL)(context.Background(), "tcp", "hs2.example.com:10001")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected the 407 to be reported, got %v", err)
+	}
+}
+
+func TestEnvironmentProxyDialer(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "all_proxy", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("ALL_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("NO_PROXY", ".internal.example.com,hs2-direct.example.com")
+
+	var dialed []string
+	dial := environmentProxyDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("not connected")
+	})
+	for _, addr := range []string{"hs2-direct.example.com:10000", "hs2.internal.example.com:10000", "hs2.example.com:10000"} {
+		dial(context.Background(), "tcp", addr)
+	}
+	want := []string{"hs2-direct.example.com:10000", "hs2.internal.example.com:10000", "proxy.example.com:3128"}
+	if strings.Join(dialed, ",") != strings.Join(want, ",") {
+		t.Errorf("dialed %q, want %q", dialed, want)
+	}
+}
@@ -0,0 +1,52 @@
+package sasl
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const MAX_TRACE_LENGTH = 255
+
+type AnonymousMechanism struct {
+	mechanismConfig *MechanismConfig
+	trace           string
+}
+
+func NewAnonymousMechanism(trace string) *AnonymousMechanism {
+	return &AnonymousMechanism{
+		mechanismConfig: newDefaultConfig("ANONYMOUS"),
+		trace:           trace,
+	}
+}
+
+func (a *AnonymousMechanism) start() ([]byte, error) {
+	return a.step(nil)
+}
+
+// The only message is the optional trace information (RFC 4505), which is
+// limited to 255 UTF-8 encoded characters.
+func (a *AnonymousMechanism) step(challenge []byte) ([]byte, error) {
+	if !utf8.ValidString(a.trace) {
+		return nil, fmt.Errorf("anonymous trace information is not valid UTF-8")
+	}
+	if utf8.RuneCountInString(a.trace) > MAX_TRACE_LENGTH {
+		return nil, fmt.Errorf("anonymous trace information is longer than %d characters", MAX_TRACE_LENGTH)
+	}
+
+	a.mechanismConfig.complete = true
+	return []byte(a.trace), nil
+}
+
+func (a *AnonymousMechanism) encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (a *AnonymousMechanism) decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (a *AnonymousMechanism) dispose() {}
+
+func (a *AnonymousMechanism) getConfig() *MechanismConfig {
+	return a.mechanismConfig
+}
@@ -0,0 +1,31 @@
+package sasl
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+	"hash"
+)
+
+const TLS_SERVER_END_POINT_PREFIX = "tls-server-end-point:"
+
+// TLSServerEndPoint returns the RFC 5929 tls-server-end-point channel binding
+// for the certificate presented by the server. MD5 and SHA-1 signatures are
+// upgraded to SHA-256 as the RFC requires.
+func TLSServerEndPoint(cert *x509.Certificate) ([]byte, error) {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.DSAWithSHA256, x509.ECDSAWithSHA256:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("no tls-server-end-point hash defined for signature algorithm %v", cert.SignatureAlgorithm)
+	}
+	h.Write(cert.Raw)
+	return append([]byte(TLS_SERVER_END_POINT_PREFIX), h.Sum(nil)...), nil
+}
@@ -21,6 +21,13 @@ func NewSaslClient(host string, mechanism Mechanism) *Client {
 	}
 }
 
+// SetAuthorizationID makes the mechanism ask to act as authzid once
+// authenticated.
+func (c *Client) SetAuthorizationID(authzid string) {
+	c.AuthorizationID = authzid
+	c.GetConfig().AuthorizationID = authzid
+}
+
 func (c *Client) Start() ([]byte, error) {
 	return c.mechanism.start()
 }
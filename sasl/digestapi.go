@@ -1,9 +1,13 @@
 package sasl
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rc4"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -11,6 +15,24 @@ import (
 
 var randSeqChars = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
+// DIGEST_CIPHER_KEY_LENGTH lists the supported auth-conf ciphers in order of
+// preference with the number of H(A1) bytes used to derive their keys.
+var DIGEST_CIPHER_KEY_LENGTH = []struct {
+	Name   string
+	Length int
+}{
+	{"rc4", 16},
+	{"rc4-56", 7},
+	{"rc4-40", 5},
+}
+
+const (
+	DIGEST_MAC_LENGTH     = 10
+	DIGEST_TRAILER_LENGTH = 16
+	DIGEST_DEFAULT_MAXBUF = 65536
+	DIGEST_MAX_MAXBUF     = 16777215
+)
+
 type DigestMD5Mechanism struct {
 	mechanismConfig *MechanismConfig
 	service         string
@@ -23,6 +45,20 @@ type DigestMD5Mechanism struct {
 	nonce      string
 	keyHash    string
 	auth       string
+	cipher     string
+	// UserSelectQop restricts the qop bits the client accepts, see QopMask.
+	UserSelectQop uint8
+
+	serverMaxBuf int
+
+	sendSeq    uint32
+	recvSeq    uint32
+	sendMAC    hash.Hash
+	recvMAC    hash.Hash
+	sendSum    [md5.Size]byte
+	recvSum    [md5.Size]byte
+	sendCipher *rc4.Cipher
+	recvCipher *rc4.Cipher
 }
 
 func NewDigestMD5Mechanism(service, username, password string) *DigestMD5Mechanism {
@@ -31,6 +67,7 @@ func NewDigestMD5Mechanism(service, username, password string) *DigestMD5Mechani
 		service:         service,
 		username:        username,
 		password:        password,
+		UserSelectQop:   QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT] | QOP_TO_FLAG[AUTH_CONF],
 	}
 }
 
@@ -43,16 +80,35 @@ func (m *DigestMD5Mechanism) step(challenge []byte) ([]byte, error) {
 		return nil, nil
 	}
 
-	c := parseChallenge(challenge)
+	c, err := parseDirectives(challenge)
+	if err != nil {
+		return nil, err
+	}
 	digestUri := m.service + "/" + m.host
 
 	if _, ok := c["rspauth"]; ok {
+		if err := m.authenticate(digestUri, c); err != nil {
+			return nil, err
+		}
+		if m.auth != AUTH {
+			m.securityLayer()
+		}
 		m.mechanismConfig.complete = true
-		return nil, m.authenticate(digestUri, c)
+		return nil, nil
+	}
+
+	if c["maxbuf"] != "" {
+		maxbuf, err := strconv.Atoi(c["maxbuf"])
+		if err != nil || maxbuf <= DIGEST_TRAILER_LENGTH {
+			return nil, fmt.Errorf("invalid maxbuf %q in DIGEST-MD5 challenge", c["maxbuf"])
+		}
+		m.serverMaxBuf = maxbuf
 	}
 
 	m.nonce = c["nonce"]
-	m.auth = c["qop"]
+	if m.auth, m.cipher, err = m.selectQop(c); err != nil {
+		return nil, err
+	}
 	if m.nonceCount == 0 {
 		m.cnonce = randSeq(14)
 	}
@@ -60,10 +116,21 @@ func (m *DigestMD5Mechanism) step(challenge []byte) ([]byte, error) {
 
 	a2String := "AUTHENTICATE:" + digestUri
 
-	maxBuf := ""
+	directives := ""
 	if m.auth != AUTH {
 		a2String += ":00000000000000000000000000000000"
-		maxBuf = ",maxbuf=16777215"
+		// The server must not send frames larger than the transport reads.
+		maxbuf := DIGEST_MAX_MAXBUF
+		if recvMaxLength := m.mechanismConfig.recvMaxLength; recvMaxLength > 0 && recvMaxLength < maxbuf {
+			maxbuf = recvMaxLength
+		}
+		directives = ",maxbuf=" + strconv.Itoa(maxbuf)
+	}
+	if m.cipher != "" {
+		directives += ",cipher=" + m.cipher
+	}
+	if authzid := m.mechanismConfig.AuthorizationID; authzid != "" {
+		directives += ",authzid=" + strconv.Quote(authzid)
 	}
 
 	nc := fmt.Sprintf("%08x", m.nonceCount)
@@ -73,17 +140,63 @@ func (m *DigestMD5Mechanism) step(challenge []byte) ([]byte, error) {
 	res := "qop=" + m.auth + ",realm=" + strconv.Quote(c["realm"]) + ",username=" +
 		strconv.Quote(m.username) + ",nonce=" + strconv.Quote(m.nonce) + ",cnonce=" +
 		strconv.Quote(m.cnonce) + ",nc=" + nc + ",digest-uri=" + strconv.Quote(digestUri) +
-		",response=" + resHash + maxBuf
+		",response=" + resHash + directives
 
 	return []byte(res), nil
 }
 
 func (m *DigestMD5Mechanism) encode(outgoing []byte) ([]byte, error) {
-	return outgoing, nil
+	if m.auth == AUTH || m.auth == "" {
+		return outgoing, nil
+	}
+
+	n := len(outgoing)
+	wrapped := make([]byte, n+DIGEST_TRAILER_LENGTH)
+	trailer := wrapped[n+DIGEST_MAC_LENGTH:]
+	trailer[0], trailer[1] = 0x00, 0x01
+	seq := trailer[2:]
+	binary.BigEndian.PutUint32(seq, m.sendSeq)
+	m.sendSeq++
+	mac := digestMAC(m.sendMAC, seq, outgoing, m.sendSum[:])
+
+	if m.sendCipher != nil {
+		m.sendCipher.XORKeyStream(wrapped[:n], outgoing)
+		m.sendCipher.XORKeyStream(wrapped[n:n+DIGEST_MAC_LENGTH], mac)
+	} else {
+		copy(wrapped, outgoing)
+		copy(wrapped[n:], mac)
+	}
+	return wrapped, nil
 }
 
 func (m *DigestMD5Mechanism) decode(incoming []byte) ([]byte, error) {
-	return incoming, nil
+	if m.auth == AUTH || m.auth == "" {
+		return incoming, nil
+	}
+
+	if len(incoming) < DIGEST_TRAILER_LENGTH {
+		return nil, fmt.Errorf("DIGEST-MD5 message is too short (%d)", len(incoming))
+	}
+	trailer := incoming[len(incoming)-6:]
+	if trailer[0] != 0x00 || trailer[1] != 0x01 {
+		return nil, fmt.Errorf("DIGEST-MD5 message has an unknown version")
+	}
+	seq := trailer[2:]
+	if binary.BigEndian.Uint32(seq) != m.recvSeq {
+		return nil, fmt.Errorf("DIGEST-MD5 message is out of sequence")
+	}
+	m.recvSeq++
+
+	// The message is decrypted in place and returned without a copy.
+	body := incoming[:len(incoming)-6]
+	if m.recvCipher != nil {
+		m.recvCipher.XORKeyStream(body, body)
+	}
+	message, mac := body[:len(body)-DIGEST_MAC_LENGTH], body[len(body)-DIGEST_MAC_LENGTH:]
+	if !hmac.Equal(mac, digestMAC(m.recvMAC, seq, message, m.recvSum[:])) {
+		return nil, fmt.Errorf("DIGEST-MD5 message integrity check failed")
+	}
+	return message, nil
 }
 
 func (m *DigestMD5Mechanism) dispose() {
@@ -107,13 +220,78 @@ func (m *DigestMD5Mechanism) authenticate(digestUri string, challengeMap map[str
 	return nil
 }
 
-func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string,
-	challengeMap map[string]string) string {
-	if m.keyHash == "" {
-		x := m.username + ":" + challengeMap["realm"] + ":" + m.password
-		byteKeyHash := md5.Sum([]byte(x))
-		m.keyHash = string(byteKeyHash[:])
+// selectQop picks the strongest qop offered by the server that the client
+// accepts. auth-conf is only considered when a supported cipher is offered.
+func (m *DigestMD5Mechanism) selectQop(challengeMap map[string]string) (string, string, error) {
+	offered := challengeMap["qop"]
+	if offered == "" {
+		offered = AUTH
 	}
+
+	cipher := ""
+	ciphers := strings.Split(challengeMap["cipher"], ",")
+l:
+	for _, supported := range DIGEST_CIPHER_KEY_LENGTH {
+		for _, name := range ciphers {
+			if strings.TrimSpace(name) == supported.Name {
+				cipher = supported.Name
+				break l
+			}
+		}
+	}
+
+	var available byte
+	for _, qop := range strings.Split(offered, ",") {
+		qop = strings.TrimSpace(qop)
+		if qop == AUTH_CONF && cipher == "" {
+			continue
+		}
+		available |= QOP_TO_FLAG[qop]
+	}
+
+	for _, qop := range []string{AUTH_CONF, AUTH_INT, AUTH} {
+		if QOP_TO_FLAG[qop]&available&m.UserSelectQop != 0 {
+			if qop != AUTH_CONF {
+				cipher = ""
+			}
+			return qop, cipher, nil
+		}
+	}
+	return "", "", fmt.Errorf("the server offers qop %s, none of which is acceptable (%s)",
+		offered, qopNames(m.UserSelectQop))
+}
+
+// securityLayer derives the RFC 2831 integrity and confidentiality keys.
+func (m *DigestMD5Mechanism) securityLayer() {
+	ha1 := m.a1Hash()
+	kic := md5.Sum(append(deepCopy(ha1), "Digest session key to client-to-server signing key magic constant"...))
+	kis := md5.Sum(append(deepCopy(ha1), "Digest session key to server-to-client signing key magic constant"...))
+	m.sendMAC, m.recvMAC = hmac.New(md5.New, kic[:]), hmac.New(md5.New, kis[:])
+
+	serverMaxBuf := m.serverMaxBuf
+	if serverMaxBuf == 0 {
+		serverMaxBuf = DIGEST_DEFAULT_MAXBUF
+	}
+	// RC4 needs no padding, so the trailer is the only overhead.
+	m.mechanismConfig.rawSendSize = serverMaxBuf - DIGEST_TRAILER_LENGTH
+	m.mechanismConfig.securityLayer = true
+
+	if m.auth != AUTH_CONF {
+		return
+	}
+	n := 16
+	for _, supported := range DIGEST_CIPHER_KEY_LENGTH {
+		if supported.Name == m.cipher {
+			n = supported.Length
+		}
+	}
+	kcc := md5.Sum(append(deepCopy(ha1[:n]), "Digest H(A1) to client-to-server sealing key magic constant"...))
+	kcs := md5.Sum(append(deepCopy(ha1[:n]), "Digest H(A1) to server-to-client sealing key magic constant"...))
+	m.sendCipher, _ = rc4.NewCipher(kcc[:])
+	m.recvCipher, _ = rc4.NewCipher(kcs[:])
+}
+
+func (m *DigestMD5Mechanism) a1Hash() []byte {
 	a1String := []string{
 		m.keyHash,
 		m.nonce,
@@ -125,7 +303,17 @@ func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string,
 	}
 
 	h1 := md5.Sum([]byte(strings.Join(a1String, ":")))
-	a1 := hex.EncodeToString(h1[:])
+	return h1[:]
+}
+
+func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string,
+	challengeMap map[string]string) string {
+	if m.keyHash == "" {
+		x := m.username + ":" + challengeMap["realm"] + ":" + m.password
+		byteKeyHash := md5.Sum([]byte(x))
+		m.keyHash = string(byteKeyHash[:])
+	}
+	a1 := hex.EncodeToString(m.a1Hash())
 
 	h2 := md5.Sum([]byte(a2String))
 	a2 := hex.EncodeToString(h2[:])
@@ -140,39 +328,77 @@ func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string,
 	return string(res)
 }
 
-func parseChallenge(challenge []byte) map[string]string {
-	s := string(challenge)
+// digestMAC computes the truncated HMAC of seq and message into sum.
+func digestMAC(h hash.Hash, seq, message, sum []byte) []byte {
+	h.Reset()
+	h.Write(seq)
+	h.Write(message)
+	return h.Sum(sum[:0])[:DIGEST_MAC_LENGTH]
+}
 
+// parseDirectives parses the comma separated name=value list of RFC 2831,
+// where values are tokens or quoted strings with backslash escapes. Only realm
+// may be repeated, the first one is kept.
+func parseDirectives(data []byte) (map[string]string, error) {
+	s := string(data)
 	c := make(map[string]string)
 
-	for len(s) > 0 {
-		eq := strings.Index(s, "=")
-		key := s[:eq]
-		s = s[eq+1:]
-		isQuote := false
-		search := ","
-		if s[0:1] == "\"" {
-			isQuote = true
-			search = "\""
-			s = s[1:]
+	for {
+		s = strings.TrimLeft(s, " \t\r\n,")
+		if s == "" {
+			return c, nil
 		}
-		co := strings.Index(s, search)
-		if co == -1 {
-			co = len(s)
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed DIGEST-MD5 directive %q", s)
 		}
-		v := s[:co]
-		switch {
-		case isQuote && len(s) > len(v)+1:
-			s = s[co+2:]
-		case co < len(s):
-			s = s[co+1:]
-		default:
-			s = ""
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		if key == "" || strings.ContainsAny(key, " \t\",") {
+			return nil, fmt.Errorf("malformed DIGEST-MD5 directive name %q", s[:eq])
+		}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+					if i == len(s) {
+						break
+					}
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted value for DIGEST-MD5 directive %s", key)
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+			if value == "" || strings.ContainsAny(value, "\"\\") {
+				return nil, fmt.Errorf("malformed value for DIGEST-MD5 directive %s", key)
+			}
 		}
-		c[key] = v
-	}
 
-	return c
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s != "" && s[0] != ',' {
+			return nil, fmt.Errorf("missing comma after DIGEST-MD5 directive %s", key)
+		}
+		if _, ok := c[key]; ok {
+			if key == "realm" {
+				continue
+			}
+			return nil, fmt.Errorf("duplicate DIGEST-MD5 directive %s", key)
+		}
+		c[key] = value
+	}
 }
 
 func randSeq(n int) string {
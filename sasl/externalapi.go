@@ -0,0 +1,41 @@
+package sasl
+
+type ExternalMechanism struct {
+	mechanismConfig *MechanismConfig
+}
+
+// NewExternalMechanism returns a mechanism relying on an identity that was
+// established outside of SASL, such as a TLS client certificate.
+func NewExternalMechanism() *ExternalMechanism {
+	config := newDefaultConfig("EXTERNAL")
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	return &ExternalMechanism{
+		mechanismConfig: config,
+	}
+}
+
+func (e *ExternalMechanism) start() ([]byte, error) {
+	return e.step(nil)
+}
+
+// The initial response only carries the authorization identity. An empty
+// response asks the server to derive it from the external credentials.
+func (e *ExternalMechanism) step(challenge []byte) ([]byte, error) {
+	e.mechanismConfig.complete = true
+	return []byte(e.mechanismConfig.AuthorizationID), nil
+}
+
+func (e *ExternalMechanism) encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (e *ExternalMechanism) decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (e *ExternalMechanism) dispose() {}
+
+func (e *ExternalMechanism) getConfig() *MechanismConfig {
+	return e.mechanismConfig
+}
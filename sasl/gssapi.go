@@ -2,113 +2,172 @@ package sasl
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+)
 
-	gssapi "github.com/Galzzly/gssapi"
+const (
+	KERBEROS_PROVIDER_GSSAPI = "gssapi"
+	KERBEROS_PROVIDER_GOKRB5 = "gokrb5"
 )
 
+const HOST_PLACEHOLDER = "_HOST"
+
 type GSSAPIMechanism struct {
 	config           *MechanismConfig
 	host             string
 	user             string
 	service          string
 	negotiationStage int
-	context          *GSSAPIContext
+	context          GSSAPIProvider
+	newContext       func() (GSSAPIProvider, error)
 	qop              byte
 	supportedQop     uint8
 	serverMaxLength  int
 	UserSelectQop    uint8
 	MaxLength        int
+	// Principal is the full server principal, e.g. hive/_HOST@EXAMPLE.COM.
+	// When empty the service name and host are used instead.
+	Principal            string
+	CanonicalizeHostName bool
+	// ChannelBinding is the application data of the channel bindings, e.g.
+	// from TLSServerEndPoint.
+	ChannelBinding []byte
+	serviceName    string
 }
 
-type GSSAPIContext struct {
-	DebugLog       bool
-	RunAsService   bool
-	ServiceName    string
-	ServiceAddress string
+// GSSAPIProvider is the Kerberos security context driven by GSSAPIMechanism.
+// InitSecContext is called with a nil token first and then with every server
+// challenge until it reports the context as complete.
+type GSSAPIProvider interface {
+	InitSecContext(service string, intoken []byte) (token []byte, complete bool, err error)
+	SetChannelBinding(applicationData []byte) error
+	Wrap(original []byte, conf_flag bool) ([]byte, error)
+	WrapSizeLimit(outputSize int, conf_flag bool) (int, error)
+	Unwrap(original []byte) ([]byte, error)
+	IntegAvail() bool
+	ConfAvail() bool
+	Dispose() error
+}
+
+// NewGSSAPIMechanism uses the system GSSAPI library, which requires cgo, and
+// the default credentials of the process.
+func NewGSSAPIMechanism(service string) *GSSAPIMechanism {
+	return NewGSSAPIMechanismForClient(service, "")
+}
 
-	gssapi.Options
+// NewGSSAPIMechanismForClient uses the system GSSAPI library with the
+// credentials of clientPrincipal, e.g. from a credential cache collection.
+func NewGSSAPIMechanismForClient(service, clientPrincipal string) *GSSAPIMechanism {
+	return newGSSAPIMechanism(service, func() (GSSAPIProvider, error) {
+		return newGSSAPIContext(clientPrincipal)
+	})
+}
 
-	*gssapi.Lib `json:"-"`
-	// loadonce    sync.Once
+// NewKerberosGSSAPIMechanism uses the pure-Go Kerberos implementation, logging
+// in with the keytab or credential cache given in settings.
+func NewKerberosGSSAPIMechanism(service string, settings KerberosSettings) *GSSAPIMechanism {
+	return newGSSAPIMechanism(service, func() (GSSAPIProvider, error) {
+		return newKrb5Context(NewKerberosLogin(settings), true), nil
+	})
+}
 
-	// credential     *gssapi.CredId
-	token []byte
-	// continueNeeded bool
-	contextId  *gssapi.CtxId
-	reqFlags   uint32
-	availFlags uint32
+// NewKerberosGSSAPIMechanismWithLogin uses the pure-Go Kerberos implementation
+// with credentials shared across reconnects. The login is not closed when the
+// mechanism is disposed.
+func NewKerberosGSSAPIMechanismWithLogin(service string, login *KerberosLogin) *GSSAPIMechanism {
+	return newGSSAPIMechanism(service, func() (GSSAPIProvider, error) {
+		return newKrb5Context(login, false), nil
+	})
 }
 
-func NewGSSAPIMechanism(service string) *GSSAPIMechanism {
-	context := newGSSAPIContext()
+// NewGSSAPIMechanismWithProvider drives the given provider, such as a
+// FakeGSSAPIProvider in tests.
+func NewGSSAPIMechanismWithProvider(service string, provider GSSAPIProvider) *GSSAPIMechanism {
+	return newGSSAPIMechanism(service, func() (GSSAPIProvider, error) {
+		return provider, nil
+	})
+}
+
+func newGSSAPIMechanism(service string, newContext func() (GSSAPIProvider, error)) *GSSAPIMechanism {
 	return &GSSAPIMechanism{
 		config:           newDefaultConfig("GSSAPI"),
 		service:          service,
 		negotiationStage: 0,
-		context:          context,
+		newContext:       newContext,
 		supportedQop:     QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_CONF] | QOP_TO_FLAG[AUTH_INT],
 		MaxLength:        DEFAULT_MAX_LENGTH,
 		UserSelectQop:    QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT] | QOP_TO_FLAG[AUTH_CONF],
 	}
 }
 
-func newGSSAPIContext() *GSSAPIContext {
-	var context = &GSSAPIContext{
-		reqFlags: uint32(gssapi.GSS_C_INTEG_FLAG) + uint32(gssapi.GSS_C_MUTUAL_FLAG) +
-			uint32(gssapi.GSS_C_SEQUENCE_FLAG) + uint32(gssapi.GSS_C_CONF_FLAG),
+func (m *GSSAPIMechanism) start() ([]byte, error) {
+	if m.context == nil {
+		context, err := m.newContext()
+		if err != nil {
+			return nil, err
+		}
+		if m.ChannelBinding != nil {
+			if err := context.SetChannelBinding(m.ChannelBinding); err != nil {
+				context.Dispose()
+				return nil, err
+			}
+		}
+		m.context = context
 	}
-
-	prefix := "sasl-client"
-	err := loadlib(context.DebugLog, prefix, context)
+	serviceName, err := m.fullServiceName()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	j, _ := json.MarshalIndent(context, "", " ")
-	context.Debug(fmt.Sprintf("Config: %s", string(j)))
-	return context
-}
-
-func (m *GSSAPIMechanism) start() ([]byte, error) {
+	m.serviceName = serviceName
 	return m.step(nil)
 }
 
-func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
-	var serviceHostQualified, fullServiceName string
+func (m *GSSAPIMechanism) fullServiceName() (string, error) {
+	if m.Principal != "" {
+		return ServicePrincipal(m.Principal, m.host, m.CanonicalizeHostName)
+	}
 
-	serviceHostQualified = os.Getenv("SERVICE_HOST_QUALIFIED")
-	fullServiceName = m.service + "/" + serviceHostQualified
+	serviceHostQualified := os.Getenv("SERVICE_HOST_QUALIFIED")
+	fullServiceName := m.service + "/" + serviceHostQualified
 	if len(serviceHostQualified) == 0 {
 		fullServiceName += m.host
 	}
+	return fullServiceName, nil
+}
+
+func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
+	fullServiceName := m.serviceName
 
 	switch {
 	case m.negotiationStage == 0:
-		err := initClientContext(m.context, fullServiceName, nil)
+		token, _, err := m.context.InitSecContext(fullServiceName, nil)
 		m.negotiationStage = 1
-		return m.context.token, err
+		return token, err
 	case m.negotiationStage == 1:
-		err := initClientContext(m.context, fullServiceName, challenge)
+		token, complete, err := m.context.InitSecContext(fullServiceName, challenge)
 		if err != nil {
-			log.Fatal(err)
 			return nil, err
 		}
 
-		if m.user == "" {
-			return m.context.token, nil
+		if !complete {
+			return token, nil
 		}
 
-		if !m.context.integAvail() && !m.context.confAvail() {
+		if !m.context.ConfAvail() {
+			m.supportedQop &^= QOP_TO_FLAG[AUTH_CONF]
+		}
+		if !m.context.IntegAvail() {
+			m.supportedQop &^= QOP_TO_FLAG[AUTH_INT] | QOP_TO_FLAG[AUTH_CONF]
 			log.Println("Unable to establish a security layer, however authentication is still possible.")
 		}
 		m.negotiationStage = 2
-		return m.context.token, nil
+		return token, nil
 	case m.negotiationStage == 2:
-		data, err := m.context.unwrap(challenge)
+		data, err := m.context.Unwrap(challenge)
 		if err != nil {
 			return nil, err
 		}
@@ -121,7 +180,14 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 
 		m.qop, err = m.selectQop(qopBits)
 		if err != nil {
-			m.MaxLength = 0
+			return nil, err
+		}
+		if m.qop != QOP_TO_FLAG[AUTH] {
+			m.config.securityLayer = true
+			m.config.rawSendSize, err = m.context.WrapSizeLimit(m.serverMaxLength, m.qop == QOP_TO_FLAG[AUTH_CONF])
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		header := make([]byte, 4)
@@ -139,7 +205,7 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 			name = m.config.AuthorizationID
 		}
 		out := append(header, []byte(name)...)
-		wrappedOut, err := m.context.wrap(out, false)
+		wrappedOut, err := m.context.Wrap(out, false)
 
 		m.config.complete = true
 		return wrappedOut, err
@@ -147,6 +213,13 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 	return nil, fmt.Errorf("error, should not get to this point")
 }
 
+// ContextEstablished reports whether the security context is complete, which
+// for HTTP Negotiate means the server's mutual authentication token checked
+// out.
+func (m *GSSAPIMechanism) ContextEstablished() bool {
+	return m.negotiationStage == 2
+}
+
 func (m *GSSAPIMechanism) encode(outgoing []byte) ([]byte, error) {
 	if m.qop == QOP_TO_FLAG[AUTH] {
 		return outgoing, nil
@@ -155,18 +228,20 @@ func (m *GSSAPIMechanism) encode(outgoing []byte) ([]byte, error) {
 	if m.qop == QOP_TO_FLAG[AUTH_CONF] {
 		conf_flag = true
 	}
-	return m.context.wrap(deepCopy(outgoing), conf_flag)
+	return m.context.Wrap(outgoing, conf_flag)
 }
 
 func (m *GSSAPIMechanism) decode(incoming []byte) ([]byte, error) {
 	if m.qop == QOP_TO_FLAG[AUTH] {
 		return incoming, nil
 	}
-	return m.context.unwrap(deepCopy(incoming))
+	return m.context.Unwrap(incoming)
 }
 
 func (m *GSSAPIMechanism) dispose() {
-	m.context.dispose()
+	if m.context != nil {
+		m.context.Dispose()
+	}
 }
 
 func (m *GSSAPIMechanism) selectQop(qopByte byte) (byte, error) {
@@ -177,65 +252,53 @@ func (m *GSSAPIMechanism) selectQop(qopByte byte) (byte, error) {
 		}
 	}
 
-	return byte(0), fmt.Errorf("no qop available")
+	return byte(0), fmt.Errorf("the server offers qop %s, none of which is acceptable (%s)",
+		qopNames(qopByte), qopNames(m.UserSelectQop&m.supportedQop))
 }
 
 func (m *GSSAPIMechanism) getConfig() *MechanismConfig {
 	return m.config
 }
 
-func (c *GSSAPIContext) wrap(original []byte, conf_flag bool) (wrapped []byte, err error) {
-	if original == nil {
-		return
-	}
-
-	_orig, err := c.MakeBufferBytes(original)
-	defer _orig.Release()
-	if err != nil {
-		return nil, err
-	}
-
-	_, buf, err := c.contextId.Wrap(conf_flag, gssapi.GSS_C_QOP_DEFAULT, _orig)
-	defer buf.Release()
-	if err != nil {
-		return nil, err
+// ServicePrincipal substitutes _HOST in the instance of a principal such as
+// hive/_HOST@EXAMPLE.COM with host. When canonicalize is set, host is first
+// replaced by the name found through a forward and reverse DNS lookup.
+func ServicePrincipal(principal, host string, canonicalize bool) (string, error) {
+	name, realm := principal, ""
+	if at := strings.LastIndex(principal, "@"); at >= 0 {
+		name, realm = principal[:at], principal[at+1:]
 	}
-	return buf.Bytes(), nil
-}
 
-func (c *GSSAPIContext) unwrap(original []byte) (unrwapped []byte, err error) {
-	if original == nil {
-		return
+	slash := strings.Index(name, "/")
+	if slash <= 0 || slash == len(name)-1 {
+		return "", fmt.Errorf("principal %q should have the form service/host[@REALM]", principal)
 	}
+	service, instance := name[:slash], name[slash+1:]
 
-	_orig, err := c.MakeBufferBytes(original)
-	defer _orig.Release()
-	if err != nil {
-		return nil, err
+	if instance == HOST_PLACEHOLDER {
+		if canonicalize {
+			host = canonicalHostName(host)
+		}
+		instance = strings.ToLower(host)
 	}
 
-	buf, _, _, err := c.contextId.Unwrap(_orig)
-	defer buf.Release()
-	if err != nil {
-		return nil, err
+	if realm == "" {
+		return service + "/" + instance, nil
 	}
-
-	return buf.Bytes(), nil
+	return service + "/" + instance + "@" + realm, nil
 }
 
-func (c *GSSAPIContext) dispose() error {
-	if c.contextId != nil {
-		return c.contextId.Unload()
+// canonicalHostName falls back to host when it cannot be resolved.
+func canonicalHostName(host string) string {
+	addrs, err := net.LookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		return host
 	}
-	return nil
-}
-
-func (c *GSSAPIContext) integAvail() bool {
-	return c.availFlags&uint32(gssapi.GSS_C_INTEG_FLAG) != 0
-}
-
-func (c *GSSAPIContext) confAvail() bool {
-	return c.availFlags&uint32(gssapi.GSS_C_CONF_FLAG) != 0
+	names, err := net.LookupAddr(addrs[0])
+	if err != nil || len(names) == 0 {
+		return host
+	}
+	return strings.TrimSuffix(names[0], ".")
 }
 
 func deepCopy(original []byte) []byte {
@@ -246,64 +309,3 @@ func deepCopy(original []byte) []byte {
 	copy(copied, original)
 	return copied
 }
-
-func initClientContext(context *GSSAPIContext, service string, intoken []byte) error {
-	context.ServiceName = service
-
-	var _token *gssapi.Buffer
-	var err error
-	_token = context.GSS_C_NO_BUFFER
-	if intoken != nil {
-		_token, err = context.MakeBufferBytes(intoken)
-		defer _token.Release()
-		if err != nil {
-			return err
-		}
-	}
-
-	prepName := prepareServiceName(context)
-	defer prepName.Release()
-
-	contextId, _, token, outFlags, _, err := context.InitSecContext(
-		nil,
-		context.contextId,
-		prepName,
-		context.GSS_MECH_KRB5,
-		context.reqFlags,
-		0,
-		context.GSS_C_NO_CHANNEL_BINDINGS,
-		_token)
-	defer token.Release()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	context.token = token.Bytes()
-	context.contextId = contextId
-	context.availFlags = outFlags
-
-	return nil
-}
-
-func prepareServiceName(context *GSSAPIContext) *gssapi.Name {
-	if context.ServiceName == "" {
-		log.Fatal("Need a service name to be provided")
-	}
-
-	nameBuf, err := context.MakeBufferString(context.ServiceName)
-	defer nameBuf.Release()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	name, err := nameBuf.Name(context.GSS_KRB5_NT_PRINCIPAL_NAME)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if name.String() != context.ServiceName {
-		log.Fatalf("name: got %q, expected %q", name.String(), context.ServiceName)
-	}
-
-	return name
-}
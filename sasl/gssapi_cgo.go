@@ -0,0 +1,310 @@
+//go:build cgo
+
+package sasl
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <gssapi/gssapi.h>
+
+static gss_channel_bindings_t new_channel_bindings(void *data, size_t length) {
+	gss_channel_bindings_t cb = calloc(1, sizeof(struct gss_channel_bindings_struct));
+	if (cb == NULL) {
+		return NULL;
+	}
+	cb->application_data.value = malloc(length);
+	if (cb->application_data.value == NULL) {
+		free(cb);
+		return NULL;
+	}
+	memcpy(cb->application_data.value, data, length);
+	cb->application_data.length = length;
+	return cb;
+}
+
+static void free_channel_bindings(gss_channel_bindings_t cb) {
+	free(cb->application_data.value);
+	free(cb);
+}
+
+static OM_uint32 wrap_gss_wrap_size_limit(void *fp, OM_uint32 *minor_status,
+	gss_ctx_id_t context_handle, int conf_req_flag, OM_uint32 req_output_size,
+	OM_uint32 *max_input_size) {
+	return ((OM_uint32(*) (OM_uint32 *, gss_ctx_id_t, int, gss_qop_t, OM_uint32,
+		OM_uint32 *))fp)(minor_status, context_handle, conf_req_flag,
+		GSS_C_QOP_DEFAULT, req_output_size, max_input_size);
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"unsafe"
+
+	gssapi "github.com/Galzzly/gssapi"
+)
+
+type GSSAPIContext struct {
+	DebugLog       bool
+	RunAsService   bool
+	ServiceName    string
+	ServiceAddress string
+
+	gssapi.Options
+
+	*gssapi.Lib `json:"-"`
+	// loadonce    sync.Once
+
+	credential *gssapi.CredId
+	token      []byte
+	// continueNeeded bool
+	contextId       *gssapi.CtxId
+	reqFlags        uint32
+	availFlags      uint32
+	channelBindings C.gss_channel_bindings_t
+}
+
+func newGSSAPIContext(clientPrincipal string) (GSSAPIProvider, error) {
+	var context = &GSSAPIContext{
+		reqFlags: uint32(gssapi.GSS_C_INTEG_FLAG) + uint32(gssapi.GSS_C_MUTUAL_FLAG) +
+			uint32(gssapi.GSS_C_SEQUENCE_FLAG) + uint32(gssapi.GSS_C_CONF_FLAG),
+	}
+
+	prefix := "sasl-client"
+	err := loadlib(context.DebugLog, prefix, context)
+	if err != nil {
+		return nil, err
+	}
+
+	j, _ := json.MarshalIndent(context, "", " ")
+	context.Debug(fmt.Sprintf("Config: %s", string(j)))
+
+	if clientPrincipal != "" {
+		context.credential, err = acquireClientCredential(context, clientPrincipal)
+		if err != nil {
+			context.Unload()
+			return nil, err
+		}
+	}
+	return context, nil
+}
+
+func (c *GSSAPIContext) InitSecContext(service string, intoken []byte) ([]byte, bool, error) {
+	complete, err := initClientContext(c, service, intoken)
+	return c.token, complete, err
+}
+
+func (c *GSSAPIContext) Wrap(original []byte, conf_flag bool) (wrapped []byte, err error) {
+	if original == nil {
+		return
+	}
+
+	_orig, err := c.MakeBufferBytes(original)
+	defer _orig.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	_, buf, err := c.contextId.Wrap(conf_flag, gssapi.GSS_C_QOP_DEFAULT, _orig)
+	defer buf.Release()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WrapSizeLimit calls gss_wrap_size_limit, which the binding does not expose.
+func (c *GSSAPIContext) WrapSizeLimit(outputSize int, conf_flag bool) (int, error) {
+	var minor, maxInput C.OM_uint32
+	conf := C.int(0)
+	if conf_flag {
+		conf = 1
+	}
+
+	major := C.wrap_gss_wrap_size_limit(c.Fp_gss_wrap_size_limit, &minor,
+		C.gss_ctx_id_t(unsafe.Pointer(c.contextId.C_gss_ctx_id_t)), conf,
+		C.OM_uint32(outputSize), &maxInput)
+	if major != 0 {
+		return 0, fmt.Errorf("gss_wrap_size_limit failed: major %d, minor %d", major, minor)
+	}
+	return int(maxInput), nil
+}
+
+func (c *GSSAPIContext) Unwrap(original []byte) (unrwapped []byte, err error) {
+	if original == nil {
+		return
+	}
+
+	_orig, err := c.MakeBufferBytes(original)
+	defer _orig.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, _, _, err := c.contextId.Unwrap(_orig)
+	defer buf.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SetChannelBinding passes the application data with unspecified addresses,
+// matching the channel bindings computed by the gokrb5 provider.
+func (c *GSSAPIContext) SetChannelBinding(applicationData []byte) error {
+	if c.channelBindings != nil {
+		C.free_channel_bindings(c.channelBindings)
+		c.channelBindings = nil
+	}
+	if len(applicationData) == 0 {
+		return nil
+	}
+
+	data := C.CBytes(applicationData)
+	defer C.free(data)
+	c.channelBindings = C.new_channel_bindings(data, C.size_t(len(applicationData)))
+	if c.channelBindings == nil {
+		return fmt.Errorf("unable to allocate channel bindings")
+	}
+	return nil
+}
+
+func (c *GSSAPIContext) Dispose() error {
+	if c.channelBindings != nil {
+		C.free_channel_bindings(c.channelBindings)
+		c.channelBindings = nil
+	}
+	if c.credential != nil {
+		c.credential.Release()
+		c.credential = nil
+	}
+	if c.contextId != nil {
+		return c.contextId.Unload()
+	}
+	return nil
+}
+
+func (c *GSSAPIContext) IntegAvail() bool {
+	return c.availFlags&uint32(gssapi.GSS_C_INTEG_FLAG) != 0
+}
+
+func (c *GSSAPIContext) ConfAvail() bool {
+	return c.availFlags&uint32(gssapi.GSS_C_CONF_FLAG) != 0
+}
+
+func initClientContext(context *GSSAPIContext, service string, intoken []byte) (bool, error) {
+	context.ServiceName = service
+
+	var _token *gssapi.Buffer
+	var err error
+	_token = context.GSS_C_NO_BUFFER
+	if intoken != nil {
+		_token, err = context.MakeBufferBytes(intoken)
+		defer _token.Release()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	prepName, err := prepareServiceName(context)
+	if err != nil {
+		return false, err
+	}
+	defer prepName.Release()
+
+	contextId, _, token, outFlags, _, err := context.Lib.InitSecContext(
+		context.credential,
+		context.contextId,
+		prepName,
+		context.GSS_MECH_KRB5,
+		context.reqFlags,
+		0,
+		gssapi.ChannelBindings(unsafe.Pointer(context.channelBindings)),
+		_token)
+	if err != nil && err != gssapi.ErrContinueNeeded {
+		return false, err
+	}
+	defer token.Release()
+
+	context.token = token.Bytes()
+	context.contextId = contextId
+	context.availFlags = outFlags
+
+	return err == nil, nil
+}
+
+func prepareServiceName(context *GSSAPIContext) (*gssapi.Name, error) {
+	if context.ServiceName == "" {
+		return nil, fmt.Errorf("need a service name to be provided")
+	}
+
+	nameBuf, err := context.MakeBufferString(context.ServiceName)
+	defer nameBuf.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := nameBuf.Name(context.GSS_KRB5_NT_PRINCIPAL_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	if name.String() != context.ServiceName {
+		return nil, fmt.Errorf("name: got %q, expected %q", name.String(), context.ServiceName)
+	}
+
+	return name, nil
+}
+
+func acquireClientCredential(context *GSSAPIContext, principal string) (*gssapi.CredId, error) {
+	nameBuf, err := context.MakeBufferString(principal)
+	if err != nil {
+		return nil, err
+	}
+	defer nameBuf.Release()
+
+	name, err := nameBuf.Name(context.GSS_KRB5_NT_PRINCIPAL_NAME)
+	if err != nil {
+		return nil, err
+	}
+	defer name.Release()
+
+	mechs, err := context.MakeOIDSet(context.GSS_MECH_KRB5)
+	if err != nil {
+		return nil, err
+	}
+	defer mechs.Release()
+
+	credential, actualMechs, _, err := context.AcquireCred(name, gssapi.GSS_C_INDEFINITE, mechs, gssapi.GSS_C_INITIATE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to acquire credentials for %s: %v", principal, err)
+	}
+	actualMechs.Release()
+	return credential, nil
+}
+
+func loadlib(debug bool, prefix string, context *GSSAPIContext) error {
+	max := gssapi.Err + 1
+	if debug {
+		max = gssapi.MaxSeverity
+	}
+	pp := make([]gssapi.Printer, 0, max)
+	for i := gssapi.Severity(0); i < max; i++ {
+		p := log.New(os.Stderr,
+			fmt.Sprintf("%s: %s\t", prefix, i),
+			log.LstdFlags)
+		pp = append(pp, p)
+	}
+	context.Options.Printers = pp
+
+	lib, err := gssapi.Load(&context.Options)
+	if err != nil {
+		return err
+	}
+	context.Lib = lib
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package sasl
+
+import "errors"
+
+func newGSSAPIContext(clientPrincipal string) (GSSAPIProvider, error) {
+	return nil, errors.New("the gssapi Kerberos provider requires cgo, use the gokrb5 provider instead")
+}
@@ -0,0 +1,218 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+const allQops = 1 | 2 | 4
+
+// negotiateGSSAPI runs the fake negotiation up to the security layer
+// challenge, which offers qopBits and serverMaxLength.
+func negotiateGSSAPI(t *testing.T, provider *FakeGSSAPIProvider, m *GSSAPIMechanism,
+	qopBits byte, serverMaxLength uint32) ([]byte, error) {
+	t.Helper()
+	t.Setenv("SERVICE_HOST_QUALIFIED", "")
+	client := NewSaslClient("hs2.example.com", m)
+	if _, err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Step([]byte("server-token")); err != nil {
+		t.Fatal(err)
+	}
+	return client.Step(provider.SecurityLayerChallenge(qopBits, serverMaxLength))
+}
+
+func TestGSSAPIStages(t *testing.T) {
+	t.Setenv("SERVICE_HOST_QUALIFIED", "")
+	provider := &FakeGSSAPIProvider{Rounds: 2}
+	m := NewGSSAPIMechanismWithProvider("hive", provider)
+	m.ChannelBinding = []byte("binding")
+	client := NewSaslClient("hs2.example.com", m)
+	client.SetAuthorizationID("alice")
+
+	token, err := client.Start()
+	if err != nil || string(token) != "fake-token-0" || m.negotiationStage != 1 {
+		t.Fatalf("start: %q, %v, stage %d", token, err, m.negotiationStage)
+	}
+	token, err = client.Step([]byte("challenge-1"))
+	if err != nil || string(token) != "fake-token-1" || m.negotiationStage != 1 {
+		t.Fatalf("first challenge: %q, %v, stage %d", token, err, m.negotiationStage)
+	}
+	token, err = client.Step([]byte("challenge-2"))
+	if err != nil || token != nil || m.negotiationStage != 2 {
+		t.Fatalf("second challenge: %q, %v, stage %d", token, err, m.negotiationStage)
+	}
+	if client.Complete() {
+		t.Fatal("complete before the security layer was negotiated")
+	}
+
+	token, err = client.Step(provider.SecurityLayerChallenge(allQops, 65536))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.Complete() {
+		t.Error("not complete after the security layer was negotiated")
+	}
+	want := []byte{FAKE_WRAP_INTEG, QOP_TO_FLAG[AUTH_CONF], 0x01, 0x00, 0x00}
+	if !bytes.Equal(token, append(want, "alice"...)) {
+		t.Errorf("security layer response %x", token)
+	}
+
+	for _, service := range provider.Services {
+		if service != "hive/hs2.example.com" {
+			t.Errorf("service %q", service)
+		}
+	}
+	if len(provider.Challenges) != 2 {
+		t.Errorf("provider saw %d challenges", len(provider.Challenges))
+	}
+	if string(provider.ChannelBinding) != "binding" {
+		t.Errorf("channel binding %q", provider.ChannelBinding)
+	}
+
+	client.Dispose()
+	if !provider.Disposed {
+		t.Error("the provider was not disposed")
+	}
+}
+
+func TestGSSAPIServicePrincipal(t *testing.T) {
+	provider := &FakeGSSAPIProvider{}
+	m := NewGSSAPIMechanismWithProvider("hive", provider)
+	m.Principal = "hive/_HOST@EXAMPLE.COM"
+	if _, err := negotiateGSSAPI(t, provider, m, allQops, 65536); err != nil {
+		t.Fatal(err)
+	}
+	if provider.Services[0] != "hive/hs2.example.com@EXAMPLE.COM" {
+		t.Errorf("service %q", provider.Services[0])
+	}
+}
+
+func TestGSSAPIQopSelection(t *testing.T) {
+	tests := []struct {
+		name           string
+		offered        byte
+		userSelect     byte
+		noIntegrity    bool
+		noConfidential bool
+		want           string
+		err            string
+	}{
+		{name: "strongest", offered: allQops, userSelect: allQops, want: AUTH_CONF},
+		{name: "server limits", offered: QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT], userSelect: allQops, want: AUTH_INT},
+		{name: "user limits", offered: allQops, userSelect: QOP_TO_FLAG[AUTH], want: AUTH},
+		{name: "no confidentiality", offered: allQops, userSelect: allQops, noConfidential: true, want: AUTH_INT},
+		{name: "no integrity", offered: allQops, userSelect: allQops, noIntegrity: true, want: AUTH},
+		{
+			name: "none acceptable", offered: QOP_TO_FLAG[AUTH], userSelect: QOP_TO_FLAG[AUTH_CONF],
+			err: "none of which is acceptable",
+		},
+		{
+			name: "none available", offered: QOP_TO_FLAG[AUTH_CONF], userSelect: allQops, noConfidential: true,
+			err: "none of which is acceptable",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &FakeGSSAPIProvider{NoIntegrity: test.noIntegrity, NoConfidentiality: test.noConfidential}
+			m := NewGSSAPIMechanismWithProvider("hive", provider)
+			m.UserSelectQop = test.userSelect
+			token, err := negotiateGSSAPI(t, provider, m, test.offered, 65536)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				if m.config.complete {
+					t.Error("complete after a failed qop selection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.qop != QOP_TO_FLAG[test.want] || token[1] != QOP_TO_FLAG[test.want] {
+				t.Errorf("selected qop %d, sent %d, want %s", m.qop, token[1], test.want)
+			}
+			if m.config.securityLayer != (test.want != AUTH) {
+				t.Errorf("security layer %v for %s", m.config.securityLayer, test.want)
+			}
+		})
+	}
+}
+
+func TestGSSAPIMaxLength(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxLength       int
+		serverMaxLength uint32
+		want            uint32
+	}{
+		{name: "server smaller", maxLength: DEFAULT_MAX_LENGTH, serverMaxLength: 4096, want: 4096},
+		{name: "client smaller", maxLength: 1024, serverMaxLength: 65536, want: 1024},
+		{name: "equal", maxLength: 2048, serverMaxLength: 2048, want: 2048},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &FakeGSSAPIProvider{}
+			m := NewGSSAPIMechanismWithProvider("hive", provider)
+			m.MaxLength = test.maxLength
+			token, err := negotiateGSSAPI(t, provider, m, allQops, test.serverMaxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.serverMaxLength != int(test.serverMaxLength) {
+				t.Errorf("server max length %d", m.serverMaxLength)
+			}
+			header := binary.BigEndian.Uint32(token[1:5])
+			if got := header & 0xffffff; got != test.want {
+				t.Errorf("max length %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGSSAPIRawSendSize(t *testing.T) {
+	for _, qop := range []string{AUTH_INT, AUTH_CONF} {
+		t.Run(qop, func(t *testing.T) {
+			provider := &FakeGSSAPIProvider{}
+			m := NewGSSAPIMechanismWithProvider("hive", provider)
+			m.UserSelectQop = QOP_TO_FLAG[qop]
+			if _, err := negotiateGSSAPI(t, provider, m, allQops, 8192); err != nil {
+				t.Fatal(err)
+			}
+			// The fake wrap token adds one byte.
+			if m.config.rawSendSize != 8191 {
+				t.Errorf("raw send size %d, want 8191", m.config.rawSendSize)
+			}
+
+			wrapped, err := m.encode([]byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			marker := FAKE_WRAP_INTEG
+			if qop == AUTH_CONF {
+				marker = FAKE_WRAP_CONF
+			}
+			if wrapped[0] != marker {
+				t.Errorf("wrapped with %q, want %q", wrapped[0], marker)
+			}
+			unwrapped, err := m.decode(wrapped)
+			if err != nil || string(unwrapped) != "payload" {
+				t.Errorf("unwrapped %q, %v", unwrapped, err)
+			}
+		})
+	}
+
+	provider := &FakeGSSAPIProvider{}
+	m := NewGSSAPIMechanismWithProvider("hive", provider)
+	m.UserSelectQop = QOP_TO_FLAG[AUTH]
+	if _, err := negotiateGSSAPI(t, provider, m, allQops, 8192); err != nil {
+		t.Fatal(err)
+	}
+	if m.config.securityLayer || m.config.rawSendSize != 0 {
+		t.Errorf("auth has a security layer of %d bytes", m.config.rawSendSize)
+	}
+}
@@ -0,0 +1,371 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const DEFAULT_KRB5_CONFIG = "/etc/krb5.conf"
+
+// RFC 4121 wrap token flags
+const (
+	WRAP_FLAG_SENT_BY_ACCEPTOR byte = 0x01
+	WRAP_FLAG_SEALED           byte = 0x02
+	WRAP_FLAG_ACCEPTOR_SUBKEY  byte = 0x04
+)
+
+const WRAP_TOKEN_HEADER_LENGTH = 16
+
+// KerberosSettings configures the pure-Go Kerberos provider. A keytab takes
+// precedence over the credential cache. Empty paths fall back to KRB5_CONFIG
+// and KRB5CCNAME, then to the MIT defaults. Principal selects the client
+// identity, otherwise the first keytab entry or the cache owner is used.
+type KerberosSettings struct {
+	ConfigPath string
+	KeytabPath string
+	CCachePath string
+	Principal  string
+}
+
+type krb5Context struct {
+	login          *KerberosLogin
+	ownLogin       bool
+	sessionKey     types.EncryptionKey
+	key            types.EncryptionKey
+	acceptorSubkey bool
+	sendSeq        uint64
+	flags          uint32
+	channelBinding []byte
+}
+
+func newKrb5Context(login *KerberosLogin, ownLogin bool) *krb5Context {
+	return &krb5Context{login: login, ownLogin: ownLogin}
+}
+
+func (s KerberosSettings) configPath() string {
+	if s.ConfigPath != "" {
+		return s.ConfigPath
+	}
+	if env := os.Getenv("KRB5_CONFIG"); env != "" {
+		return strings.Split(env, ":")[0]
+	}
+	return DEFAULT_KRB5_CONFIG
+}
+
+func (s KerberosSettings) ccachePath() (string, error) {
+	path := s.CCachePath
+	if path == "" {
+		path = os.Getenv("KRB5CCNAME")
+	}
+	if path == "" {
+		return "/tmp/krb5cc_" + strconv.Itoa(os.Getuid()), nil
+	}
+	if strings.HasPrefix(path, "FILE:") {
+		return strings.TrimPrefix(path, "FILE:"), nil
+	}
+	if i := strings.Index(path, ":"); i > 0 && !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("credential cache type %s is not supported, only FILE caches can be read", path[:i])
+	}
+	return path, nil
+}
+
+func (c *krb5Context) InitSecContext(service string, intoken []byte) ([]byte, bool, error) {
+	if intoken == nil {
+		token, err := c.apReq(service)
+		return token, false, err
+	}
+	return nil, true, c.apRep(intoken)
+}
+
+// apReq obtains a service ticket and builds the initial context token.
+func (c *krb5Context) apReq(service string) ([]byte, error) {
+	spn, realm := splitPrincipal(service)
+	cl, tkt, sessionKey, err := c.login.serviceTicket(spn, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sessionKey.KeyType {
+	case etypeID.DES_CBC_CRC, etypeID.DES_CBC_MD5, etypeID.RC4_HMAC:
+		return nil, fmt.Errorf("encryption type %d is not supported by the gokrb5 provider", sessionKey.KeyType)
+	}
+	e, err := crypto.GetEtype(sessionKey.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	c.flags = krb5gssapi.ContextFlagMutual | krb5gssapi.ContextFlagInteg |
+		krb5gssapi.ContextFlagConf | krb5gssapi.ContextFlagSequence
+
+	auth, err := types.NewAuthenticator(cl.Credentials.Domain(), cl.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  c.authenticatorChecksum(),
+	}
+	if err := auth.GenerateSeqNumberAndSubKey(sessionKey.KeyType, e.GetKeyByteSize()); err != nil {
+		return nil, err
+	}
+
+	apReq, err := messages.NewAPReq(tkt, sessionKey, auth)
+	if err != nil {
+		return nil, err
+	}
+	types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+
+	b, err := apReq.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	c.sessionKey = sessionKey
+	c.key = auth.SubKey
+	c.sendSeq = uint64(auth.SeqNumber)
+
+	return krb5Token(spnego.TOK_ID_KRB_AP_REQ, b)
+}
+
+// apRep verifies the acceptor's reply and switches to its subkey if one was
+// sent.
+func (c *krb5Context) apRep(token []byte) error {
+	tokID, body, err := parseKrb5Token(token)
+	if err != nil {
+		return err
+	}
+
+	switch tokID {
+	case spnego.TOK_ID_KRB_AP_REP:
+	case spnego.TOK_ID_KRB_ERROR:
+		var krbError messages.KRBError
+		if err := krbError.Unmarshal(body); err != nil {
+			return err
+		}
+		return krbError
+	default:
+		return fmt.Errorf("unexpected Kerberos token %s", tokID)
+	}
+
+	var apRep messages.APRep
+	if err := apRep.Unmarshal(body); err != nil {
+		return err
+	}
+	b, err := crypto.DecryptEncPart(apRep.EncPart, c.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt AP-REP: %v", err)
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(b); err != nil {
+		return err
+	}
+
+	if part.Subkey.KeyType != 0 {
+		c.key = part.Subkey
+		c.acceptorSubkey = true
+	}
+	return nil
+}
+
+// authenticatorChecksum builds the RFC 4121 section 4.1.1 checksum carrying
+// the channel binding hash and the requested context flags.
+func (c *krb5Context) authenticatorChecksum() []byte {
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	if c.channelBinding != nil {
+		copy(checksum[4:20], channelBindingHash(c.channelBinding))
+	}
+	binary.LittleEndian.PutUint32(checksum[20:24], c.flags)
+	return checksum
+}
+
+// channelBindingHash is the MD5 of the gss_channel_bindings_struct encoding
+// with unspecified addresses, as computed by MIT Kerberos and Java.
+func channelBindingHash(applicationData []byte) []byte {
+	b := make([]byte, 20, 20+len(applicationData))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(len(applicationData)))
+	b = append(b, applicationData...)
+	sum := md5.Sum(b)
+	return sum[:]
+}
+
+func (c *krb5Context) SetChannelBinding(applicationData []byte) error {
+	c.channelBinding = applicationData
+	return nil
+}
+
+func (c *krb5Context) Wrap(original []byte, conf_flag bool) ([]byte, error) {
+	e, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, WRAP_TOKEN_HEADER_LENGTH)
+	header[0], header[1] = 0x05, 0x04
+	if c.acceptorSubkey {
+		header[2] |= WRAP_FLAG_ACCEPTOR_SUBKEY
+	}
+	header[3] = 0xFF
+	binary.BigEndian.PutUint64(header[8:], c.sendSeq)
+	c.sendSeq++
+
+	// EC and RRC are still zero, which is what both the encrypted header copy
+	// and the checksum input require.
+	message := make([]byte, len(original), len(original)+WRAP_TOKEN_HEADER_LENGTH)
+	copy(message, original)
+
+	if conf_flag {
+		header[2] |= WRAP_FLAG_SEALED
+		_, sealed, err := e.EncryptMessage(c.key.KeyValue, append(message, header...), keyusage.GSSAPI_INITIATOR_SEAL)
+		if err != nil {
+			return nil, err
+		}
+		return append(header, sealed...), nil
+	}
+
+	checksum, err := e.GetChecksumHash(c.key.KeyValue, append(message, header...), keyusage.GSSAPI_INITIATOR_SIGN)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(checksum)))
+
+	wrapped := make([]byte, 0, len(header)+len(original)+len(checksum))
+	wrapped = append(wrapped, header...)
+	wrapped = append(wrapped, original...)
+	return append(wrapped, checksum...), nil
+}
+
+func (c *krb5Context) WrapSizeLimit(outputSize int, conf_flag bool) (int, error) {
+	e, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return 0, err
+	}
+	overhead := WRAP_TOKEN_HEADER_LENGTH + e.GetHMACBitLength()/8
+	if conf_flag {
+		overhead += WRAP_TOKEN_HEADER_LENGTH + e.GetConfounderByteSize()
+	}
+	if outputSize <= overhead {
+		return 0, fmt.Errorf("buffer size %d is too small for a wrap token", outputSize)
+	}
+	return outputSize - overhead, nil
+}
+
+func (c *krb5Context) Unwrap(original []byte) ([]byte, error) {
+	if len(original) < WRAP_TOKEN_HEADER_LENGTH || original[0] != 0x05 || original[1] != 0x04 || original[3] != 0xFF {
+		return nil, fmt.Errorf("invalid wrap token")
+	}
+	flag := original[2]
+	if flag&WRAP_FLAG_SENT_BY_ACCEPTOR == 0 {
+		return nil, fmt.Errorf("wrap token was not sent by the acceptor")
+	}
+
+	e, err := crypto.GetEtype(c.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	ec := int(binary.BigEndian.Uint16(original[4:6]))
+	rrc := int(binary.BigEndian.Uint16(original[6:8]))
+	header := deepCopy(original[:WRAP_TOKEN_HEADER_LENGTH])
+	header[6], header[7] = 0, 0
+	data := rotateLeft(original[WRAP_TOKEN_HEADER_LENGTH:], rrc)
+
+	if flag&WRAP_FLAG_SEALED != 0 {
+		if len(data) < e.GetHMACBitLength()/8 {
+			return nil, fmt.Errorf("wrap token is too short")
+		}
+		plain, err := e.DecryptMessage(c.key.KeyValue, data, keyusage.GSSAPI_ACCEPTOR_SEAL)
+		if err != nil {
+			return nil, err
+		}
+		if len(plain) < ec+WRAP_TOKEN_HEADER_LENGTH {
+			return nil, fmt.Errorf("wrap token is too short")
+		}
+		if !bytes.Equal(plain[len(plain)-WRAP_TOKEN_HEADER_LENGTH:], header) {
+			return nil, fmt.Errorf("wrap token header does not match its encrypted copy")
+		}
+		return plain[:len(plain)-WRAP_TOKEN_HEADER_LENGTH-ec], nil
+	}
+
+	if len(data) < ec {
+		return nil, fmt.Errorf("wrap token is too short")
+	}
+	payload, checksum := data[:len(data)-ec], data[len(data)-ec:]
+	header[4], header[5] = 0, 0
+	if !e.VerifyChecksum(c.key.KeyValue, append(deepCopy(payload), header...), checksum, keyusage.GSSAPI_ACCEPTOR_SIGN) {
+		return nil, fmt.Errorf("wrap token checksum is invalid")
+	}
+	return payload, nil
+}
+
+func (c *krb5Context) IntegAvail() bool {
+	return c.flags&krb5gssapi.ContextFlagInteg != 0
+}
+
+func (c *krb5Context) ConfAvail() bool {
+	return c.flags&krb5gssapi.ContextFlagConf != 0
+}
+
+func (c *krb5Context) Dispose() error {
+	if c.ownLogin {
+		c.login.Close()
+	}
+	return nil
+}
+
+// krb5Token frames a Kerberos message as an RFC 2743 initial context token.
+func krb5Token(tokID string, message []byte) ([]byte, error) {
+	b, err := asn1.Marshal(krb5gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	id, _ := hex.DecodeString(tokID)
+	b = append(b, id...)
+	b = append(b, message...)
+	return asn1tools.AddASNAppTag(b, 0), nil
+}
+
+func parseKrb5Token(token []byte) (tokID string, body []byte, err error) {
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.UnmarshalWithParams(token, &oid, "application,explicit,tag:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Kerberos token: %v", err)
+	}
+	if !oid.Equal(krb5gssapi.OIDKRB5.OID()) {
+		return "", nil, fmt.Errorf("unexpected mechanism %s in Kerberos token", oid.String())
+	}
+	if len(rest) < 2 {
+		return "", nil, fmt.Errorf("Kerberos token is too short")
+	}
+	return hex.EncodeToString(rest[:2]), rest[2:], nil
+}
+
+// rotateLeft undoes the right rotation by count (RRC) applied by the sender.
+func rotateLeft(data []byte, count int) []byte {
+	rotated := make([]byte, len(data))
+	if len(data) == 0 {
+		return rotated
+	}
+	count %= len(data)
+	copy(rotated, data[count:])
+	copy(rotated[len(data)-count:], data[:count])
+	return rotated
+}
@@ -0,0 +1,418 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const testKrb5Conf = `[libdefaults]
+  default_realm = EXAMPLE.COM
+  dns_lookup_kdc = false
+  dns_lookup_realm = false
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = 127.0.0.1:1
+  }
+`
+
+func testKey(t *testing.T) types.EncryptionKey {
+	t.Helper()
+	e, err := crypto.GetEtype(etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := types.GenerateEncryptionKey(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// acceptorWrap builds an RFC 4121 wrap token as sent by the acceptor, with
+// the data rotated right by rrc.
+func acceptorWrap(t *testing.T, key types.EncryptionKey, payload []byte, conf bool, rrc int) []byte {
+	t.Helper()
+	e, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, WRAP_TOKEN_HEADER_LENGTH)
+	header[0], header[1], header[2], header[3] = 0x05, 0x04, WRAP_FLAG_SENT_BY_ACCEPTOR, 0xFF
+	binary.BigEndian.PutUint64(header[8:], 7)
+
+	var data []byte
+	if conf {
+		header[2] |= WRAP_FLAG_SEALED
+		_, data, err = e.EncryptMessage(key.KeyValue, append(deepCopy(payload), header...), keyusage.GSSAPI_ACCEPTOR_SEAL)
+	} else {
+		var checksum []byte
+		checksum, err = e.GetChecksumHash(key.KeyValue, append(deepCopy(payload), header...), keyusage.GSSAPI_ACCEPTOR_SIGN)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(checksum)))
+		data = append(deepCopy(payload), checksum...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary.BigEndian.PutUint16(header[6:8], uint16(rrc))
+	rrc %= len(data)
+	rotated := append(deepCopy(data[len(data)-rrc:]), data[:len(data)-rrc]...)
+	return append(header, rotated...)
+}
+
+func TestKrb5WrapIntegrity(t *testing.T) {
+	key := testKey(t)
+	c := &krb5Context{key: key, sendSeq: 41}
+
+	for seq := uint64(41); seq < 43; seq++ {
+		token, err := c.Wrap([]byte("payload"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wt krb5gssapi.WrapToken
+		if err := wt.Unmarshal(token, false); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := wt.Verify(key, keyusage.GSSAPI_INITIATOR_SIGN); !ok {
+			t.Fatalf("checksum does not verify: %v", err)
+		}
+		if string(wt.Payload) != "payload" || wt.SndSeqNum != seq || wt.Flags != 0 {
+			t.Errorf("token %q, sequence %d, flags %x", wt.Payload, wt.SndSeqNum, wt.Flags)
+		}
+	}
+}
+
+func TestKrb5WrapConfidentiality(t *testing.T) {
+	key := testKey(t)
+	c := &krb5Context{key: key}
+
+	token, err := c.Wrap([]byte("secret payload"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token[2] != WRAP_FLAG_SEALED {
+		t.Errorf("flags %x", token[2])
+	}
+	if bytes.Contains(token, []byte("secret payload")) {
+		t.Error("the payload was sent in the clear")
+	}
+
+	e, _ := crypto.GetEtype(key.KeyType)
+	plain, err := e.DecryptMessage(key.KeyValue, token[WRAP_TOKEN_HEADER_LENGTH:], keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte("secret payload"), token[:WRAP_TOKEN_HEADER_LENGTH]...)
+	if !bytes.Equal(plain, want) {
+		t.Errorf("decrypted %x, want %x", plain, want)
+	}
+}
+
+func TestKrb5WrapAcceptorSubkey(t *testing.T) {
+	c := &krb5Context{key: testKey(t), acceptorSubkey: true}
+	for _, conf := range []bool{false, true} {
+		token, err := c.Wrap([]byte("payload"), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token[2]&WRAP_FLAG_ACCEPTOR_SUBKEY == 0 {
+			t.Errorf("conf %v: the acceptor subkey flag is not set", conf)
+		}
+	}
+}
+
+func TestKrb5Unwrap(t *testing.T) {
+	key := testKey(t)
+	c := &krb5Context{key: key}
+	for _, conf := range []bool{false, true} {
+		for _, rrc := range []int{0, 12, 28} {
+			token := acceptorWrap(t, key, []byte("payload"), conf, rrc)
+			payload, err := c.Unwrap(token)
+			if err != nil || string(payload) != "payload" {
+				t.Errorf("conf %v, rrc %d: %q, %v", conf, rrc, payload, err)
+			}
+		}
+	}
+}
+
+func TestKrb5UnwrapRejects(t *testing.T) {
+	key := testKey(t)
+	c := &krb5Context{key: key}
+
+	tests := []struct {
+		name   string
+		token  func() []byte
+		errMsg string
+	}{
+		{
+			name: "bad checksum",
+			token: func() []byte {
+				token := acceptorWrap(t, key, []byte("payload"), false, 0)
+				token[WRAP_TOKEN_HEADER_LENGTH] ^= 0xff
+				return token
+			},
+			errMsg: "checksum is invalid",
+		},
+		{
+			name: "other key",
+			token: func() []byte {
+				return acceptorWrap(t, testKey(t), []byte("payload"), false, 0)
+			},
+			errMsg: "checksum is invalid",
+		},
+		{
+			name: "tampered ciphertext",
+			token: func() []byte {
+				token := acceptorWrap(t, key, []byte("payload"), true, 0)
+				token[len(token)-1] ^= 0xff
+				return token
+			},
+			errMsg: "integrity",
+		},
+		{
+			name: "tampered sealed header",
+			token: func() []byte {
+				token := acceptorWrap(t, key, []byte("payload"), true, 0)
+				token[15] ^= 0xff
+				return token
+			},
+			errMsg: "does not match",
+		},
+		{
+			name: "sent by the initiator",
+			token: func() []byte {
+				token, _ := (&krb5Context{key: key}).Wrap([]byte("payload"), false)
+				return token
+			},
+			errMsg: "not sent by the acceptor",
+		},
+		{
+			name:   "truncated",
+			token:  func() []byte { return []byte{0x05, 0x04, 0x01} },
+			errMsg: "invalid wrap token",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.Unwrap(test.token())
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("expected %q, got %v", test.errMsg, err)
+			}
+		})
+	}
+}
+
+// ccacheWriter writes the version 4 credential cache format read by gokrb5.
+type ccacheWriter struct {
+	bytes.Buffer
+}
+
+func (w *ccacheWriter) int16(v int16) { binary.Write(w, binary.BigEndian, v) }
+func (w *ccacheWriter) int32(v int32) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *ccacheWriter) data(b []byte) {
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *ccacheWriter) principal(name types.PrincipalName, realm string) {
+	w.int32(name.NameType)
+	w.int32(int32(len(name.NameString)))
+	w.data([]byte(realm))
+	for _, component := range name.NameString {
+		w.data([]byte(component))
+	}
+}
+
+func (w *ccacheWriter) credential(t *testing.T, client types.PrincipalName, tkt messages.Ticket,
+	key types.EncryptionKey, start, end time.Time) {
+	b, err := tkt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.principal(client, "EXAMPLE.COM")
+	w.principal(tkt.SName, tkt.Realm)
+	w.int16(int16(key.KeyType))
+	w.data(key.KeyValue)
+	for _, ts := range []time.Time{start, start, end, end} {
+		w.int32(int32(ts.Unix()))
+	}
+	w.WriteByte(0)
+	w.Write([]byte{0, 0, 0, 0})
+	w.int32(0)
+	w.int32(0)
+	w.data(b)
+	w.data(nil)
+}
+
+// kerberosFixture writes a krb5.conf and a credential cache holding a TGT and
+// a ticket for hive/hs2.example.com, so that no KDC is contacted. The keytab
+// holds the service key.
+func kerberosFixture(t *testing.T) (KerberosSettings, *keytab.Keytab) {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	kt := keytab.New()
+	for _, principal := range []string{"krbtgt/EXAMPLE.COM", "hive/hs2.example.com"} {
+		if err := kt.AddEntry(principal, "EXAMPLE.COM", "password", now, 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "bob")
+	var w ccacheWriter
+	w.Write([]byte{0x05, 0x04, 0x00, 0x00})
+	w.principal(cname, "EXAMPLE.COM")
+	for _, sname := range []types.PrincipalName{
+		{NameType: nametype.KRB_NT_SRV_INST, NameString: []string{"krbtgt", "EXAMPLE.COM"}},
+		{NameType: nametype.KRB_NT_PRINCIPAL, NameString: []string{"hive", "hs2.example.com"}},
+	} {
+		tkt, key, err := messages.NewTicket(cname, "EXAMPLE.COM", sname, "EXAMPLE.COM", types.NewKrbFlags(),
+			kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.credential(t, cname, tkt, key, now, now.Add(time.Hour))
+	}
+
+	settings := KerberosSettings{
+		ConfigPath: filepath.Join(dir, "krb5.conf"),
+		CCachePath: filepath.Join(dir, "ccache"),
+	}
+	if err := os.WriteFile(settings.ConfigPath, []byte(testKrb5Conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(settings.CCachePath, w.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return settings, kt
+}
+
+// acceptAPReq verifies the initial context token like a service would and
+// returns its AP-REP carrying subkey.
+func acceptAPReq(t *testing.T, kt *keytab.Keytab, token []byte, subkey types.EncryptionKey) (messages.APReq, []byte) {
+	t.Helper()
+	tokID, body, err := parseKrb5Token(token)
+	if err != nil || tokID != spnego.TOK_ID_KRB_AP_REQ {
+		t.Fatalf("token %s: %v", tokID, err)
+	}
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(body); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := service.VerifyAPREQ(&apReq, service.NewSettings(kt, service.DecodePAC(false))); !ok {
+		t.Fatalf("AP-REQ does not verify: %v", err)
+	}
+
+	part, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		Subkey:         subkey,
+		SequenceNumber: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart),
+		apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := asn1.Marshal(messages.APRep{PVNO: 5, MsgType: msgtype.KRB_AP_REP, EncPart: encPart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := krb5Token(spnego.TOK_ID_KRB_AP_REP, asn1tools.AddASNAppTag(rep, asnAppTag.APREP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apReq, reply
+}
+
+func TestKrb5ContextExchange(t *testing.T) {
+	settings, kt := kerberosFixture(t)
+	login := NewKerberosLogin(settings)
+	defer login.Close()
+	cl, err := login.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedConfig := cl.Config
+
+	c := newKrb5Context(login, false)
+	c.SetChannelBinding([]byte("tls-server-end-point"))
+	token, complete, err := c.InitSecContext("hive/hs2.example.com@EXAMPLE.COM", nil)
+	if err != nil || complete {
+		t.Fatalf("AP-REQ: complete %v, %v", complete, err)
+	}
+
+	subkey := testKey(t)
+	apReq, reply := acceptAPReq(t, kt, token, subkey)
+	if apReq.Authenticator.CName.PrincipalNameString() != "bob" {
+		t.Errorf("client %s", apReq.Authenticator.CName.PrincipalNameString())
+	}
+	checksum := apReq.Authenticator.Cksum.Checksum
+	if len(checksum) != 24 || !bytes.Equal(checksum[4:20], channelBindingHash([]byte("tls-server-end-point"))) {
+		t.Errorf("authenticator checksum %x", checksum)
+	}
+	if !c.IntegAvail() || !c.ConfAvail() {
+		t.Error("integrity and confidentiality were not requested")
+	}
+	if c.key.KeyType != apReq.Authenticator.SubKey.KeyType || !bytes.Equal(c.key.KeyValue, apReq.Authenticator.SubKey.KeyValue) {
+		t.Error("the initiator subkey is not used before the AP-REP")
+	}
+
+	if _, complete, err = c.InitSecContext("hive/hs2.example.com@EXAMPLE.COM", reply); err != nil || !complete {
+		t.Fatalf("AP-REP: complete %v, %v", complete, err)
+	}
+	if !c.acceptorSubkey || !bytes.Equal(c.key.KeyValue, subkey.KeyValue) {
+		t.Error("the acceptor subkey was not adopted")
+	}
+	payload, err := c.Unwrap(acceptorWrap(t, subkey, []byte("payload"), true, 0))
+	if err != nil || string(payload) != "payload" {
+		t.Errorf("unwrapped %q, %v", payload, err)
+	}
+
+	if _, ok := loadedConfig.DomainRealm["hs2.example.com"]; ok {
+		t.Error("the realm was added to the configuration in use")
+	}
+}
+
+func TestKrb5ContextKrbError(t *testing.T) {
+	krbError := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "hive/hs2.example.com"),
+		"EXAMPLE.COM", 41, "integrity check failed")
+	b, err := krbError.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := krb5Token(spnego.TOK_ID_KRB_ERROR, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &krb5Context{}
+	if _, _, err := c.InitSecContext("hive/hs2.example.com", token); err == nil {
+		t.Fatal("expected the KRB-ERROR to be returned")
+	}
+}
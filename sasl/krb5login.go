@@ -0,0 +1,242 @@
+package sasl
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const DEFAULT_KERBEROS_RENEWAL_INTERVAL = time.Minute
+
+// KerberosLogin holds the client credentials of one connection for the gokrb5
+// provider. It is safe to share between the mechanisms created each time the
+// connection is (re)opened.
+type KerberosLogin struct {
+	settings      KerberosSettings
+	mu            sync.Mutex
+	client        *client.Client
+	ccacheModTime time.Time
+	renewing      bool
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewKerberosLogin(settings KerberosSettings) *KerberosLogin {
+	return &KerberosLogin{
+		settings: settings,
+		done:     make(chan struct{}),
+	}
+}
+
+// Client returns the logged in client, logging in on first use.
+func (l *KerberosLogin) Client() (*client.Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.client == nil {
+		if err := l.login(); err != nil {
+			return nil, err
+		}
+	}
+	return l.client, nil
+}
+
+// Refresh logs in again from the keytab once the TGT can no longer be renewed,
+// and reloads the credential cache after it has been rewritten by kinit or a
+// similar tool.
+func (l *KerberosLogin) Refresh() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.client == nil {
+		return l.login()
+	}
+	if l.settings.KeytabPath != "" {
+		return l.client.AffirmLogin()
+	}
+
+	path, err := l.settings.ccachePath()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().After(l.ccacheModTime) {
+		return l.login()
+	}
+	return nil
+}
+
+// serviceTicket obtains a ticket for spn with the logged in client. An
+// explicit realm takes precedence over the domain_realm mapping; it is added
+// to the configuration of a copy of the client, which shares its TGT and
+// ticket cache, as the client may be in use elsewhere.
+func (l *KerberosLogin) serviceTicket(spn, realm string) (*client.Client, messages.Ticket, types.EncryptionKey, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.client == nil {
+		if err := l.login(); err != nil {
+			return nil, messages.Ticket{}, types.EncryptionKey{}, err
+		}
+	}
+	cl := l.client
+
+	host := spn[strings.Index(spn, "/")+1:]
+	if realm != "" && cl.Config.ResolveRealm(host) != realm {
+		cfg := *cl.Config
+		cfg.DomainRealm = make(config.DomainRealm, len(cl.Config.DomainRealm)+1)
+		for domain, mapped := range cl.Config.DomainRealm {
+			cfg.DomainRealm[domain] = mapped
+		}
+		cfg.DomainRealm[host] = realm
+		copied := *cl
+		copied.Config = &cfg
+		cl = &copied
+	}
+	tkt, sessionKey, err := cl.GetServiceTicket(spn)
+	return cl, tkt, sessionKey, err
+}
+
+// StartRenewal refreshes the credentials every interval until Close is called.
+func (l *KerberosLogin) StartRenewal(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_KERBEROS_RENEWAL_INTERVAL
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.renewing {
+		return
+	}
+	l.renewing = true
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Refresh(); err != nil {
+					log.Printf("unable to refresh Kerberos credentials: %v", err)
+				}
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+func (l *KerberosLogin) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		l.client.Destroy()
+		l.client = nil
+	}
+}
+
+// login replaces the current client. It must be called with mu held.
+func (l *KerberosLogin) login() error {
+	cfg, err := config.Load(l.settings.configPath())
+	if err != nil {
+		return fmt.Errorf("unable to load Kerberos configuration: %v", err)
+	}
+
+	var cl *client.Client
+	if l.settings.KeytabPath != "" {
+		cl, err = l.keytabClient(cfg)
+	} else {
+		cl, err = l.ccacheClient(cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if l.client != nil {
+		l.client.Destroy()
+	}
+	l.client = cl
+	return nil
+}
+
+func (l *KerberosLogin) keytabClient(cfg *config.Config) (*client.Client, error) {
+	kt, err := keytab.Load(l.settings.KeytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load keytab %s: %v", l.settings.KeytabPath, err)
+	}
+	if len(kt.Entries) == 0 {
+		return nil, fmt.Errorf("keytab %s has no entries", l.settings.KeytabPath)
+	}
+
+	var username, realm string
+	if l.settings.Principal != "" {
+		username, realm = splitPrincipal(l.settings.Principal)
+		if realm == "" {
+			realm = cfg.LibDefaults.DefaultRealm
+		}
+	} else {
+		principal := kt.Entries[0].Principal
+		username, realm = strings.Join(principal.Components, "/"), principal.Realm
+	}
+
+	cl := client.NewWithKeytab(username, realm, kt, cfg, client.DisablePAFXFAST(true))
+	if err := cl.Login(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (l *KerberosLogin) ccacheClient(cfg *config.Config) (*client.Client, error) {
+	path, err := l.settings.ccachePath()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load credential cache %s: %v", path, err)
+	}
+	cc, err := credentials.LoadCCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load credential cache %s: %v", path, err)
+	}
+
+	if l.settings.Principal != "" {
+		username, realm := splitPrincipal(l.settings.Principal)
+		name := types.NewPrincipalName(cc.GetClientPrincipalName().NameType, username)
+		if !cc.GetClientPrincipalName().Equal(name) || (realm != "" && realm != cc.GetClientRealm()) {
+			return nil, fmt.Errorf("credential cache %s holds %s@%s, not %s", path,
+				cc.GetClientPrincipalName().PrincipalNameString(), cc.GetClientRealm(), l.settings.Principal)
+		}
+	}
+
+	cl, err := client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, err
+	}
+	l.ccacheModTime = info.ModTime()
+	return cl, nil
+}
+
+func splitPrincipal(principal string) (name, realm string) {
+	if at := strings.LastIndex(principal, "@"); at >= 0 {
+		return principal[:at], principal[at+1:]
+	}
+	return principal, ""
+}
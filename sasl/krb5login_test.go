@@ -0,0 +1,305 @@
+package sasl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// fakeKDC issues tickets for every principal of its keytab over TCP, without
+// pre-authentication.
+type fakeKDC struct {
+	kt       *keytab.Keytab
+	listener net.Listener
+
+	mu       sync.Mutex
+	lifetime time.Duration
+	asReqs   int
+	tgsReqs  []string
+}
+
+func newFakeKDC(t *testing.T, principals ...string) *fakeKDC {
+	t.Helper()
+	kt := keytab.New()
+	for _, principal := range append([]string{"krbtgt/EXAMPLE.COM"}, principals...) {
+		if err := kt.AddEntry(principal, "EXAMPLE.COM", "password", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdc := &fakeKDC{kt: kt, listener: listener, lifetime: time.Hour}
+	t.Cleanup(func() { listener.Close() })
+	go kdc.serve(t)
+	return kdc
+}
+
+func (kdc *fakeKDC) serve(t *testing.T) {
+	for {
+		conn, err := kdc.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				return
+			}
+			request := make([]byte, binary.BigEndian.Uint32(size))
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			reply, err := kdc.reply(request)
+			if err != nil {
+				t.Errorf("fake KDC: %v", err)
+				return
+			}
+			conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(reply))), reply...))
+		}()
+	}
+}
+
+func (kdc *fakeKDC) reply(request []byte) ([]byte, error) {
+	kdc.mu.Lock()
+	defer kdc.mu.Unlock()
+
+	if request[0] == 0x60|asnAppTag.ASREQ {
+		var req messages.ASReq
+		if err := req.Unmarshal(request); err != nil {
+			return nil, err
+		}
+		kdc.asReqs++
+		key, kvno, err := kdc.kt.GetEncryptionKey(req.ReqBody.CName, req.ReqBody.Realm, 0, etypeID.AES256_CTS_HMAC_SHA1_96)
+		if err != nil {
+			return nil, err
+		}
+		rep, err := kdc.issue(req.ReqBody, key, kvno, keyusage.AS_REP_ENCPART, asnAppTag.EncASRepPart)
+		if err != nil {
+			return nil, err
+		}
+		rep.MsgType = msgtype.KRB_AS_REP
+		return (&messages.ASRep{KDCRepFields: rep}).Marshal()
+	}
+
+	var req messages.TGSReq
+	if err := req.Unmarshal(request); err != nil {
+		return nil, err
+	}
+	kdc.tgsReqs = append(kdc.tgsReqs, req.ReqBody.SName.PrincipalNameString()+"@"+req.ReqBody.Realm)
+	var apReq messages.APReq
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := apReq.Ticket.DecryptEncPart(kdc.kt, nil); err != nil {
+		return nil, fmt.Errorf("TGS-REQ without a valid TGT: %v", err)
+	}
+	rep, err := kdc.issue(req.ReqBody, apReq.Ticket.DecryptedEncPart.Key, 0,
+		keyusage.TGS_REP_ENCPART_SESSION_KEY, asnAppTag.EncTGSRepPart)
+	if err != nil {
+		return nil, err
+	}
+	rep.MsgType = msgtype.KRB_TGS_REP
+	return (&messages.TGSRep{KDCRepFields: rep}).Marshal()
+}
+
+// issue creates a ticket for the request body, with the reply part encrypted
+// in key. It must be called with mu held.
+func (kdc *fakeKDC) issue(body messages.KDCReqBody, key types.EncryptionKey, kvno int,
+	usage uint32, tag int) (messages.KDCRepFields, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	end := now.Add(kdc.lifetime)
+	tkt, sessionKey, err := messages.NewTicket(body.CName, "EXAMPLE.COM", body.SName, body.Realm,
+		types.NewKrbFlags(), kdc.kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, end, time.Time{})
+	if err != nil {
+		return messages.KDCRepFields{}, err
+	}
+	part, err := asn1.Marshal(messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{{LRValue: now}},
+		Nonce:     body.Nonce,
+		Flags:     types.NewKrbFlags(),
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   end,
+		SRealm:    body.Realm,
+		SName:     body.SName,
+	})
+	if err != nil {
+		return messages.KDCRepFields{}, err
+	}
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(part, tag), key, usage, kvno)
+	if err != nil {
+		return messages.KDCRepFields{}, err
+	}
+	return messages.KDCRepFields{
+		PVNO:    5,
+		CRealm:  "EXAMPLE.COM",
+		CName:   body.CName,
+		Ticket:  tkt,
+		EncPart: encPart,
+	}, nil
+}
+
+func (kdc *fakeKDC) requests() (int, []string) {
+	kdc.mu.Lock()
+	defer kdc.mu.Unlock()
+	return kdc.asReqs, append([]string(nil), kdc.tgsReqs...)
+}
+
+// keytabSettings writes a krb5.conf pointing at kdc, which maps .other.test
+// to OTHER.COM, and the keytab of bob.
+func keytabSettings(t *testing.T, kdc *fakeKDC) KerberosSettings {
+	t.Helper()
+	dir := t.TempDir()
+	settings := KerberosSettings{
+		ConfigPath: filepath.Join(dir, "krb5.conf"),
+		KeytabPath: filepath.Join(dir, "bob.keytab"),
+		Principal:  "bob@EXAMPLE.COM",
+	}
+	conf := fmt.Sprintf(`[libdefaults]
+  default_realm = EXAMPLE.COM
+  dns_lookup_kdc = false
+  dns_lookup_realm = false
+  udp_preference_limit = 1
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = %s
+  }
+
+[domain_realm]
+  .other.test = OTHER.COM
+`, kdc.listener.Addr())
+	if err := os.WriteFile(settings.ConfigPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kdc.kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(settings.KeytabPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+func TestKerberosLoginKeytab(t *testing.T) {
+	kdc := newFakeKDC(t, "bob", "hive/hs2.example.com")
+	login := NewKerberosLogin(keytabSettings(t, kdc))
+	defer login.Close()
+
+	cl, err := login.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.Credentials.CName().PrincipalNameString() != "bob" || cl.Credentials.Domain() != "EXAMPLE.COM" {
+		t.Errorf("logged in as %s@%s", cl.Credentials.CName().PrincipalNameString(), cl.Credentials.Domain())
+	}
+
+	_, tkt, sessionKey, err := login.serviceTicket("hive/hs2.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tkt.DecryptEncPart(kdc.kt, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tkt.SName.PrincipalNameString() != "hive/hs2.example.com" ||
+		tkt.DecryptedEncPart.CName.PrincipalNameString() != "bob" ||
+		sessionKey.KeyType != tkt.DecryptedEncPart.Key.KeyType {
+		t.Errorf("ticket for %s issued to %s", tkt.SName.PrincipalNameString(), tkt.DecryptedEncPart.CName.PrincipalNameString())
+	}
+
+	// The ticket is cached.
+	if _, _, _, err := login.serviceTicket("hive/hs2.example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	asReqs, tgsReqs := kdc.requests()
+	if asReqs != 1 || len(tgsReqs) != 1 || tgsReqs[0] != "hive/hs2.example.com@EXAMPLE.COM" {
+		t.Errorf("%d AS-REQs, TGS-REQs %q", asReqs, tgsReqs)
+	}
+}
+
+func TestKerberosLoginExplicitRealm(t *testing.T) {
+	kdc := newFakeKDC(t, "bob", "hive/hs2.other.test")
+	login := NewKerberosLogin(keytabSettings(t, kdc))
+	defer login.Close()
+	cl, err := login.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := cl.Config
+
+	used, _, _, err := login.serviceTicket("hive/hs2.other.test", "EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, tgsReqs := kdc.requests(); len(tgsReqs) != 1 || tgsReqs[0] != "hive/hs2.other.test@EXAMPLE.COM" {
+		t.Errorf("TGS-REQs %q", tgsReqs)
+	}
+	if used == cl || used.Config.ResolveRealm("hs2.other.test") != "EXAMPLE.COM" {
+		t.Error("the ticket was not requested with a copy of the client")
+	}
+
+	if current, _ := login.Client(); current != cl || current.Config != config {
+		t.Fatal("the shared client was replaced")
+	}
+	if realm := cl.Config.ResolveRealm("hs2.other.test"); realm != "OTHER.COM" {
+		t.Errorf("the shared configuration resolves hs2.other.test to %s", realm)
+	}
+}
+
+func TestKerberosLoginRefresh(t *testing.T) {
+	kdc := newFakeKDC(t, "bob", "hive/hs2.example.com")
+	kdc.lifetime = time.Second
+	login := NewKerberosLogin(keytabSettings(t, kdc))
+	defer login.Close()
+
+	if _, err := login.Client(); err != nil {
+		t.Fatal(err)
+	}
+	if err := login.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if asReqs, _ := kdc.requests(); asReqs != 1 {
+		t.Fatalf("%d AS-REQs while the TGT is valid", asReqs)
+	}
+
+	kdc.mu.Lock()
+	kdc.lifetime = time.Hour
+	kdc.mu.Unlock()
+	time.Sleep(1100 * time.Millisecond)
+	if err := login.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if asReqs, _ := kdc.requests(); asReqs < 2 {
+		t.Fatal("no new TGT after the first one expired")
+	}
+	if _, _, _, err := login.serviceTicket("hive/hs2.example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,7 +4,6 @@ import "fmt"
 
 type PlainMechanism struct {
 	mechanismConfig *MechanismConfig
-	identity        string
 	username        string
 	password        string
 }
@@ -25,10 +24,6 @@ func (p *PlainMechanism) step(challenge []byte) ([]byte, error) {
 	p.mechanismConfig.complete = true
 	authId := p.mechanismConfig.AuthorizationID
 
-	if authId != "" {
-		authId = p.identity
-	}
-
 	NULL := "\x00"
 	return []byte(fmt.Sprintf("%s%s%s%s%s", authId, NULL, p.username, NULL, p.password)), nil
 }
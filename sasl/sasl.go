@@ -2,10 +2,7 @@ package sasl
 
 import (
 	"fmt"
-	"log"
-	"os"
-
-	gssapi "github.com/Galzzly/gssapi"
+	"strings"
 )
 
 const DEFAULT_MAX_LENGTH = 16384000
@@ -29,6 +26,46 @@ var QOP_TO_FLAG = map[string]byte{
 	AUTH_CONF: 4,
 }
 
+var QOP_ORDER = []string{AUTH, AUTH_INT, AUTH_CONF}
+
+// QopMask returns the qop bits from minimum up to desired, both inclusive.
+// An empty desired qop means auth-conf and an empty minimum means auth.
+func QopMask(desired, minimum string) (byte, error) {
+	if desired == "" {
+		desired = AUTH_CONF
+	}
+	if minimum == "" {
+		minimum = AUTH
+	}
+	if _, ok := QOP_TO_FLAG[desired]; !ok {
+		return 0, fmt.Errorf("unknown qop %q", desired)
+	}
+	if _, ok := QOP_TO_FLAG[minimum]; !ok {
+		return 0, fmt.Errorf("unknown qop %q", minimum)
+	}
+	if QOP_TO_FLAG[minimum] > QOP_TO_FLAG[desired] {
+		return 0, fmt.Errorf("the minimum qop %s is stronger than the desired qop %s", minimum, desired)
+	}
+
+	var mask byte
+	for _, qop := range QOP_ORDER {
+		if QOP_TO_FLAG[qop] >= QOP_TO_FLAG[minimum] && QOP_TO_FLAG[qop] <= QOP_TO_FLAG[desired] {
+			mask |= QOP_TO_FLAG[qop]
+		}
+	}
+	return mask, nil
+}
+
+func qopNames(mask byte) string {
+	names := []string{}
+	for _, qop := range QOP_ORDER {
+		if QOP_TO_FLAG[qop]&mask != 0 {
+			names = append(names, qop)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
 type MechanismConfig struct {
 	name               string
 	score              int
@@ -39,7 +76,15 @@ type MechanismConfig struct {
 	activeSafe         bool
 	disctionarySafe    bool
 	qop                []byte
-	AuthorizationID    string
+	// rawSendSize is the largest payload that encodes into a buffer the peer
+	// accepts, zero when there is no limit.
+	rawSendSize int
+	// recvMaxLength is the largest frame the transport reads, zero when
+	// there is no limit.
+	recvMaxLength int
+	// securityLayer is set once a layer wrapping every frame is negotiated.
+	securityLayer   bool
+	AuthorizationID string
 }
 
 type Mechanism interface {
@@ -65,25 +110,3 @@ func newDefaultConfig(name string) *MechanismConfig {
 		AuthorizationID:    "",
 	}
 }
-
-func loadlib(debug bool, prefix string, context *GSSAPIContext) error {
-	max := gssapi.Err + 1
-	if debug {
-		max = gssapi.MaxSeverity
-	}
-	pp := make([]gssapi.Printer, 0, max)
-	for i := gssapi.Severity(0); i < max; i++ {
-		p := log.New(os.Stderr,
-			fmt.Sprintf("%s: %s\t", prefix, i),
-			log.LstdFlags)
-		pp = append(pp, p)
-	}
-	context.Options.Printers = pp
-
-	lib, err := gssapi.Load(&context.Options)
-	if err != nil {
-		return err
-	}
-	context.Lib = lib
-	return nil
-}
@@ -0,0 +1,217 @@
+package sasl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+// ServerMechanism is the server side of a SASL mechanism. Step is called with
+// every client response, starting with the initial response that follows the
+// START message, until it reports the exchange as complete. Server mechanisms
+// do not negotiate a security layer.
+type ServerMechanism interface {
+	Name() string
+	Step(response []byte) (challenge []byte, complete bool, err error)
+	// AuthorizationID is the identity the client acts as once complete.
+	AuthorizationID() string
+}
+
+// ServerMechanismFactory creates the state for one negotiation.
+type ServerMechanismFactory func() ServerMechanism
+
+type TSaslServerTransport struct {
+	tp             thrift.TTransport
+	mechanisms     map[string]ServerMechanismFactory
+	mechanism      ServerMechanism
+	complete       bool
+	writeBuf       bytes.Buffer
+	buffer         [4]byte
+	frameSize      int
+	maxLength      uint32
+	OpeningContext context.Context
+}
+
+// NewTSaslServerTransport accepts the mechanisms keyed by their SASL name.
+func NewTSaslServerTransport(trans thrift.TTransport, mechanisms map[string]ServerMechanismFactory,
+	maxLength uint32) *TSaslServerTransport {
+	return &TSaslServerTransport{
+		tp:             trans,
+		mechanisms:     mechanisms,
+		maxLength:      maxLength,
+		OpeningContext: context.Background(),
+	}
+}
+
+func (t *TSaslServerTransport) IsOpen() bool {
+	return t.tp.IsOpen() && t.complete
+}
+
+// Open runs the server side of the negotiation on an accepted connection.
+func (t *TSaslServerTransport) Open() error {
+	if !t.tp.IsOpen() {
+		if err := t.tp.Open(); err != nil {
+			return err
+		}
+	}
+
+	status, payload, err := t.recvSaslMsg()
+	if err != nil {
+		return err
+	}
+	if status != START {
+		return t.abort(&SaslNegotiationError{Status: status, Message: "expected a START message"})
+	}
+	newMechanism, ok := t.mechanisms[string(payload)]
+	if !ok {
+		return t.abort(fmt.Errorf("unsupported mechanism %s", payload))
+	}
+	t.mechanism = newMechanism()
+
+	for {
+		status, payload, err = t.recvSaslMsg()
+		if err != nil {
+			return err
+		}
+		// Java clients send their last response, which is also the initial
+		// one for PLAIN, with COMPLETE.
+		if status != OK && status != COMPLETE {
+			return &SaslNegotiationError{Status: status, Message: string(payload)}
+		}
+
+		challenge, complete, err := t.mechanism.Step(payload)
+		if err != nil {
+			return t.abort(err)
+		}
+		if status == COMPLETE && !complete {
+			return t.abort(fmt.Errorf("the client completed the %s negotiation early", t.mechanism.Name()))
+		}
+		if complete {
+			if err = t.sendSaslMsg(COMPLETE, challenge); err != nil {
+				return err
+			}
+			t.complete = true
+			return nil
+		}
+		if err = t.sendSaslMsg(OK, challenge); err != nil {
+			return err
+		}
+	}
+}
+
+// AuthorizationID returns the identity established by the negotiation.
+func (t *TSaslServerTransport) AuthorizationID() string {
+	if t.mechanism == nil || !t.complete {
+		return ""
+	}
+	return t.mechanism.AuthorizationID()
+}
+
+func (t *TSaslServerTransport) Close() error {
+	return t.tp.Close()
+}
+
+func (t *TSaslServerTransport) Read(p []byte) (n int, err error) {
+	for t.frameSize == 0 {
+		buf := t.buffer[:4]
+		if _, err = io.ReadFull(t.tp, buf); err != nil {
+			return 0, thrift.NewTTransportExceptionFromError(err)
+		}
+		size := binary.BigEndian.Uint32(buf)
+		if size > t.maxLength {
+			return 0, thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION,
+				fmt.Sprintf("Frame size is bigger than allowed (%d)", size))
+		}
+		t.frameSize = int(size)
+	}
+
+	if len(p) > t.frameSize {
+		p = p[:t.frameSize]
+	}
+	n, err = t.tp.Read(p)
+	t.frameSize -= n
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+func (t *TSaslServerTransport) Write(p []byte) (int, error) {
+	n, err := t.writeBuf.Write(p)
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+func (t *TSaslServerTransport) Flush(ctx context.Context) error {
+	buf := t.buffer[:4]
+	binary.BigEndian.PutUint32(buf, uint32(t.writeBuf.Len()))
+	if _, err := t.tp.Write(buf); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	if _, err := t.tp.Write(t.writeBuf.Bytes()); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	t.writeBuf.Reset()
+	return thrift.NewTTransportExceptionFromError(t.tp.Flush(ctx))
+}
+
+func (t *TSaslServerTransport) RemainingBytes() uint64 {
+	return uint64(t.frameSize)
+}
+
+func (t *TSaslServerTransport) abort(cause error) error {
+	t.sendSaslMsg(BAD, []byte(cause.Error()))
+	return cause
+}
+
+func (t *TSaslServerTransport) sendSaslMsg(stat uint8, msg []byte) error {
+	h := make([]byte, 5, 5+len(msg))
+	h[0] = stat
+	binary.BigEndian.PutUint32(h[1:], uint32(len(msg)))
+	if _, err := t.tp.Write(append(h, msg...)); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return thrift.NewTTransportExceptionFromError(t.tp.Flush(t.OpeningContext))
+}
+
+func (t *TSaslServerTransport) recvSaslMsg() (int8, []byte, error) {
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(t.tp, h); err != nil {
+		return ERROR, nil, thrift.NewTTransportExceptionFromError(err)
+	}
+
+	l := binary.BigEndian.Uint32(h[1:])
+	if l > t.maxLength {
+		return ERROR, nil, thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION,
+			fmt.Sprintf("SASL message is bigger than allowed (%d)", l))
+	}
+	p := make([]byte, l)
+	if _, err := io.ReadFull(t.tp, p); err != nil {
+		return ERROR, nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return int8(h[0]), p, nil
+}
+
+// TSaslServerTransportFactory negotiates SASL on every accepted connection,
+// for use with thrift.NewTSimpleServer4 and similar.
+type TSaslServerTransportFactory struct {
+	Mechanisms map[string]ServerMechanismFactory
+	MaxLength  uint32
+}
+
+func NewTSaslServerTransportFactory(mechanisms map[string]ServerMechanismFactory,
+	maxLength uint32) *TSaslServerTransportFactory {
+	return &TSaslServerTransportFactory{
+		Mechanisms: mechanisms,
+		MaxLength:  maxLength,
+	}
+}
+
+func (f *TSaslServerTransportFactory) GetTransport(trans thrift.TTransport) (thrift.TTransport, error) {
+	transport := NewTSaslServerTransport(trans, f.Mechanisms, f.MaxLength)
+	if err := transport.Open(); err != nil {
+		trans.Close()
+		return nil, err
+	}
+	return transport, nil
+}
@@ -0,0 +1,187 @@
+package sasl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+const testMaxLength = 1 << 20
+
+func testServerMechanisms() map[string]ServerMechanismFactory {
+	return map[string]ServerMechanismFactory{
+		"PLAIN": PlainServerMechanismFactory(func(authzid, username, password string) error {
+			if username != "bob" || password != "secret" {
+				return errors.New("authentication error")
+			}
+			return nil
+		}),
+		"DIGEST-MD5": DigestMD5ServerMechanismFactory("hive", "EXAMPLE", func(username, realm string) (string, error) {
+			if username != "bob" {
+				return "", errors.New("unknown user")
+			}
+			return "secret", nil
+		}),
+	}
+}
+
+func pipe() (thrift.TTransport, thrift.TTransport) {
+	client, server := net.Pipe()
+	return thrift.NewTSocketFromConnConf(client, nil), thrift.NewTSocketFromConnConf(server, nil)
+}
+
+// roundTrip opens both ends and sends a message each way.
+func roundTrip(t *testing.T, client *TSaslTransport, server *TSaslServerTransport) {
+	t.Helper()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Open()
+	}()
+	if err := client.Open(); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	go func() {
+		client.Write([]byte("ping"))
+		client.Flush(context.Background())
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+	go func() {
+		server.Write([]byte("pong"))
+		server.Flush(context.Background())
+	}()
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+}
+
+func TestSaslServerTransportPlain(t *testing.T) {
+	clientSocket, serverSocket := pipe()
+	client := NewTSaslTransport(clientSocket, "localhost", "PLAIN",
+		map[string]string{"username": "bob", "password": "secret", "authzid": "alice"}, testMaxLength)
+	server := NewTSaslServerTransport(serverSocket, testServerMechanisms(), testMaxLength)
+	roundTrip(t, client, server)
+	if id := server.AuthorizationID(); id != "alice" {
+		t.Errorf("authorization ID = %q, want alice", id)
+	}
+}
+
+func TestSaslServerTransportDigestMD5(t *testing.T) {
+	clientSocket, serverSocket := pipe()
+	client := NewTSaslTransport(clientSocket, "localhost", "DIGEST-MD5",
+		map[string]string{"username": "bob", "password": "secret", "service": "hive"}, testMaxLength)
+	server := NewTSaslServerTransport(serverSocket, testServerMechanisms(), testMaxLength)
+	roundTrip(t, client, server)
+	if id := server.AuthorizationID(); id != "bob" {
+		t.Errorf("authorization ID = %q, want bob", id)
+	}
+}
+
+// gssapiServerMechanism plays the server side of the fake GSSAPI exchange,
+// keeping the client responses.
+type gssapiServerMechanism struct {
+	provider  *FakeGSSAPIProvider
+	responses [][]byte
+}
+
+func (m *gssapiServerMechanism) Name() string { return "GSSAPI" }
+
+func (m *gssapiServerMechanism) Step(response []byte) ([]byte, bool, error) {
+	m.responses = append(m.responses, response)
+	switch len(m.responses) {
+	case 1:
+		return []byte("server-token"), false, nil
+	case 2:
+		return m.provider.SecurityLayerChallenge(QOP_TO_FLAG[AUTH], 65536), false, nil
+	}
+	return nil, true, nil
+}
+
+func (m *gssapiServerMechanism) AuthorizationID() string {
+	if len(m.responses) < 3 || len(m.responses[2]) < 5 {
+		return ""
+	}
+	return string(m.responses[2][5:])
+}
+
+func TestSaslServerTransportGSSAPIAuthorizationID(t *testing.T) {
+	t.Setenv("SERVICE_HOST_QUALIFIED", "")
+	provider := &FakeGSSAPIProvider{}
+	mechanism := NewGSSAPIMechanismWithProvider("hive", provider)
+	mechanism.UserSelectQop = QOP_TO_FLAG[AUTH]
+	serverMechanism := &gssapiServerMechanism{provider: provider}
+
+	clientSocket, serverSocket := pipe()
+	client := NewTSaslTransportWithMechanism(clientSocket, "localhost", mechanism, testMaxLength)
+	client.SetAuthorizationID("alice")
+	server := NewTSaslServerTransport(serverSocket, map[string]ServerMechanismFactory{
+		"GSSAPI": func() ServerMechanism { return serverMechanism },
+	}, testMaxLength)
+	roundTrip(t, client, server)
+
+	// The stage 2 response is the wrapped security layer, the maximum buffer
+	// size and the authorization ID.
+	want := append([]byte{FAKE_WRAP_INTEG, QOP_TO_FLAG[AUTH], 0x01, 0x00, 0x00}, "alice"...)
+	if len(serverMechanism.responses) != 3 || !bytes.Equal(serverMechanism.responses[2], want) {
+		t.Errorf("responses %q, want %q last", serverMechanism.responses, want)
+	}
+	if id := server.AuthorizationID(); id != "alice" {
+		t.Errorf("authorization ID = %q, want alice", id)
+	}
+}
+
+func TestSaslServerTransportRejectsBadPassword(t *testing.T) {
+	clientSocket, serverSocket := pipe()
+	client := NewTSaslTransport(clientSocket, "localhost", "PLAIN",
+		map[string]string{"username": "bob", "password": "wrong"}, testMaxLength)
+	server := NewTSaslServerTransport(serverSocket, testServerMechanisms(), testMaxLength)
+	go server.Open()
+
+	var negotiationErr *SaslNegotiationError
+	if err := client.Open(); !errors.As(err, &negotiationErr) || negotiationErr.Status != BAD {
+		t.Fatalf("expected a BAD status, got %v", err)
+	}
+}
+
+// Java clients send the PLAIN response with the COMPLETE status.
+func TestSaslServerTransportPlainComplete(t *testing.T) {
+	clientSocket, serverSocket := pipe()
+	server := NewTSaslServerTransport(serverSocket, testServerMechanisms(), testMaxLength)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Open()
+	}()
+
+	writeMsg := func(status uint8, payload []byte) {
+		h := make([]byte, 5)
+		h[0] = status
+		binary.BigEndian.PutUint32(h[1:], uint32(len(payload)))
+		clientSocket.Write(append(h, payload...))
+		clientSocket.Flush(context.Background())
+	}
+	writeMsg(START, []byte("PLAIN"))
+	writeMsg(COMPLETE, []byte("\x00bob\x00secret"))
+
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(clientSocket, h); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != COMPLETE {
+		t.Errorf("status = %d, want COMPLETE", h[0])
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
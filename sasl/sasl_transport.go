@@ -6,9 +6,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/apache/thrift/lib/go/thrift"
-	"github.com/pkg/errors"
 )
 
 const (
@@ -19,46 +19,142 @@ const (
 	COMPLETE = 5
 )
 
+// MAX_POOLED_FRAME_SIZE keeps unusually large frames from being retained by
+// the frame buffer pool.
+const MAX_POOLED_FRAME_SIZE = 1 << 20
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64*1024)
+		return &b
+	},
+}
+
+func getFrameBuffer(size int) *[]byte {
+	b := framePool.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+func putFrameBuffer(b *[]byte) {
+	if cap(*b) <= MAX_POOLED_FRAME_SIZE {
+		framePool.Put(b)
+	}
+}
+
+var STATUS_NAMES = map[int8]string{
+	START:    "START",
+	OK:       "OK",
+	BAD:      "BAD",
+	ERROR:    "ERROR",
+	COMPLETE: "COMPLETE",
+}
+
+// SaslNegotiationError is returned when the server aborts the negotiation or
+// answers with an unexpected status. Message is the payload sent with it.
+type SaslNegotiationError struct {
+	Status  int8
+	Message string
+}
+
+func (e *SaslNegotiationError) Error() string {
+	name, ok := STATUS_NAMES[e.Status]
+	if !ok {
+		name = fmt.Sprintf("unknown status %d", e.Status)
+	}
+	if e.Message == "" {
+		return "SASL negotiation failed with " + name
+	}
+	return fmt.Sprintf("SASL negotiation failed with %s: %s", name, e.Message)
+}
+
 type TSaslTransport struct {
 	// service        string
 	saslClient *Client
 	tp         thrift.TTransport
 	// tpFramed       thrift.TFramedTransport
-	mechanism      string
-	writeBuf       bytes.Buffer
-	readBuf        bytes.Buffer
-	buffer         [4]byte
-	rawFrameSize   uint32
-	frameSize      int
-	maxLength      uint32
-	principal      string
+	mechanism string
+	writeBuf  bytes.Buffer
+	rawBuf    *[]byte
+	readBuf   []byte
+	buffer    [4]byte
+	frameSize int
+	maxLength uint32
+	principal string
+	// configErr is an invalid configuration reported by Open.
+	configErr      error
 	OpeningContext context.Context
 }
 
 func NewTSaslTransport(trans thrift.TTransport, host string, mechanismName string,
 	configuration map[string]string, maxLength uint32) (transport *TSaslTransport) {
 	var mechanism Mechanism
+	var configErr error
 	switch mechanismName {
 	case "PLAIN":
 		mechanism = NewPlainMechanism(configuration["username"], configuration["password"])
 	case "GSSAPI":
-		mechanism = NewGSSAPIMechanism(configuration["service"])
+		var gssapiMechanism *GSSAPIMechanism
+		if configuration["provider"] == KERBEROS_PROVIDER_GOKRB5 {
+			gssapiMechanism = NewKerberosGSSAPIMechanism(configuration["service"], KerberosSettings{
+				ConfigPath: configuration["krb5conf"],
+				KeytabPath: configuration["keytab"],
+				CCachePath: configuration["ccache"],
+				Principal:  configuration["client"],
+			})
+		} else {
+			gssapiMechanism = NewGSSAPIMechanismForClient(configuration["service"], configuration["client"])
+		}
+		gssapiMechanism.Principal = configuration["principal"]
+		gssapiMechanism.CanonicalizeHostName = configuration["canonicalize"] == "true"
+		gssapiMechanism.UserSelectQop, configErr = configurationQop(configuration)
+		mechanism = gssapiMechanism
 	case "DIGEST-MD5":
-		mechanism = NewDigestMD5Mechanism(configuration["service"], configuration["username"], configuration["password"])
+		digestMechanism := NewDigestMD5Mechanism(configuration["service"], configuration["username"], configuration["password"])
+		digestMechanism.UserSelectQop, configErr = configurationQop(configuration)
+		mechanism = digestMechanism
+	case "ANONYMOUS":
+		mechanism = NewAnonymousMechanism(configuration["trace"])
+	case "EXTERNAL":
+		mechanism = NewExternalMechanism()
 	default:
 		panic("Mechanism not supported")
 	}
+	transport = NewTSaslTransportWithMechanism(trans, host, mechanism, maxLength)
+	transport.principal = configuration["principal"]
+	transport.configErr = configErr
+	if authzid := configuration["authzid"]; authzid != "" {
+		transport.SetAuthorizationID(authzid)
+	}
+	return
+}
+
+// NewTSaslTransportWithMechanism negotiates with an already configured
+// mechanism, e.g. a GSSAPIMechanism sharing a KerberosLogin across reconnects.
+func NewTSaslTransportWithMechanism(trans thrift.TTransport, host string, mechanism Mechanism,
+	maxLength uint32) *TSaslTransport {
+	mechanism.getConfig().recvMaxLength = int(maxLength)
 	client := NewSaslClient(host, mechanism)
-	transport = &TSaslTransport{
+	return &TSaslTransport{
 		saslClient:     client,
 		tp:             trans,
-		mechanism:      mechanismName,
+		mechanism:      mechanism.getConfig().name,
 		maxLength:      maxLength,
-		principal:      configuration["principal"],
 		OpeningContext: context.Background(),
 	}
+}
 
-	return
+func configurationQop(configuration map[string]string) (byte, error) {
+	return QopMask(configuration["qop"], configuration["minqop"])
+}
+
+// SetAuthorizationID sets the identity to act as, for every mechanism that
+// carries one. It must be called before Open.
+func (t *TSaslTransport) SetAuthorizationID(authzid string) {
+	t.saslClient.SetAuthorizationID(authzid)
 }
 
 func (t *TSaslTransport) IsOpen() bool {
@@ -66,59 +162,148 @@ func (t *TSaslTransport) IsOpen() bool {
 }
 
 func (t *TSaslTransport) Open() (err error) {
+	return t.OpenContext(t.OpeningContext)
+}
+
+// OpenContext runs the SASL negotiation. When ctx is done before the
+// negotiation completes the underlying transport is closed and the context
+// error is returned.
+func (t *TSaslTransport) OpenContext(ctx context.Context) (err error) {
+	if t.configErr != nil {
+		return t.configErr
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err = ctx.Err(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
 	if !t.tp.IsOpen() {
 		if err = t.tp.Open(); err != nil {
 			return
 		}
 	}
-	if err = t.sendSaslMsg(t.OpeningContext, START, []byte(t.mechanism)); err != nil {
+
+	if ctx.Done() != nil {
+		var mu sync.Mutex
+		finished := false
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				if !finished {
+					t.tp.Close()
+				}
+				mu.Unlock()
+			case <-stop:
+			}
+		}()
+		defer func() {
+			mu.Lock()
+			finished = true
+			mu.Unlock()
+			close(stop)
+			if err != nil && ctx.Err() != nil {
+				err = thrift.NewTTransportExceptionFromError(ctx.Err())
+			}
+		}()
+	}
+
+	if err = t.sendSaslMsg(ctx, START, []byte(t.mechanism)); err != nil {
 		return
 	}
 
 	processed, err := t.saslClient.Start()
 	if err != nil {
-		return
+		return t.abort(ctx, err)
 	}
 
-	if err = t.sendSaslMsg(t.OpeningContext, OK, processed); err != nil {
+	if err = t.sendSaslMsg(ctx, OK, processed); err != nil {
 		return
 	}
 
-l:
 	for {
-		status, challenge := t.recvSaslMsg(t.OpeningContext)
+		status, challenge, err := t.recvSaslMsg(ctx)
+		if err != nil {
+			return err
+		}
+
 		switch status {
 		case OK:
 			processed, err = t.saslClient.Step(challenge)
 			if err != nil {
-				return
+				return t.abort(ctx, err)
+			}
+			if err = t.sendSaslMsg(ctx, OK, processed); err != nil {
+				return err
 			}
-			t.sendSaslMsg(t.OpeningContext, OK, processed)
 		case COMPLETE:
+			// The server may send its last challenge, such as the DIGEST-MD5
+			// rspauth, together with the COMPLETE status.
+			if !t.saslClient.Complete() && len(challenge) > 0 {
+				if _, err = t.saslClient.Step(challenge); err != nil {
+					return t.abort(ctx, err)
+				}
+			}
 			if !t.saslClient.Complete() {
 				return thrift.NewTTransportException(thrift.NOT_OPEN, "Server erroneous responded SASL negotiation was complete")
 			}
-			break l
+			return nil
 		default:
-			return thrift.NewTTransportExceptionFromError((errors.Errorf("Bad SASL negotiation status: %d (%s)", status, challenge)))
+			return &SaslNegotiationError{Status: status, Message: string(challenge)}
 		}
 	}
-	return
+}
+
+// abort reports a client side failure to the server, as the Java
+// implementation does, before returning it.
+func (t *TSaslTransport) abort(ctx context.Context, cause error) error {
+	t.sendSaslMsg(ctx, BAD, []byte(cause.Error()))
+	return cause
 }
 
 func (t *TSaslTransport) Close() error {
+	t.releaseFrame()
 	t.saslClient.Dispose()
 	return t.tp.Close()
 }
 
 func (t *TSaslTransport) Flush(ctx context.Context) error {
-	wrappedBuf, err := t.saslClient.Encode(t.writeBuf.Bytes())
-	if err != nil {
-		return thrift.NewTTransportExceptionFromError(err)
+	payload := t.writeBuf.Bytes()
+	chunkSize := t.saslClient.GetConfig().rawSendSize
+	if chunkSize <= 0 {
+		chunkSize = len(payload)
 	}
 
+	// Each chunk is wrapped into its own frame so that no frame exceeds the
+	// buffer size negotiated with the server.
+	for {
+		n := chunkSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		if err := t.writeFrame(payload[:n]); err != nil {
+			t.writeBuf.Reset()
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+	}
 	t.writeBuf.Reset()
 
+	err := t.tp.Flush(ctx)
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+func (t *TSaslTransport) writeFrame(payload []byte) error {
+	wrappedBuf, err := t.saslClient.Encode(payload)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+
 	size := len(wrappedBuf)
 	buf := t.buffer[:4]
 	binary.BigEndian.PutUint32(buf, uint32(size))
@@ -131,44 +316,72 @@ func (t *TSaslTransport) Flush(ctx context.Context) error {
 			return thrift.NewTTransportExceptionFromError(err)
 		}
 	}
-
-	err = t.tp.Flush(ctx)
-	return thrift.NewTTransportExceptionFromError(err)
+	return nil
 }
 
 func (t *TSaslTransport) Read(p []byte) (n int, err error) {
-	if t.rawFrameSize == 0 && t.frameSize == 0 {
-		t.rawFrameSize, err = t.readFrameHeader()
-		if err != nil {
+	securityLayer := t.saslClient.GetConfig().securityLayer
+	for t.frameSize == 0 {
+		var size uint32
+		if size, err = t.readFrameHeader(); err != nil {
 			return
 		}
-	}
-
-	var got int
-	if t.rawFrameSize > 0 {
-		rawBuf := make([]byte, t.rawFrameSize)
-		got, err = io.ReadFull(t.tp, rawBuf)
-		if err != nil {
+		if !securityLayer {
+			t.frameSize = int(size)
+		} else if err = t.readWrappedFrame(size); err != nil {
 			return
 		}
-		t.rawFrameSize = t.rawFrameSize - uint32(got)
+	}
 
-		var unwrappedBuf []byte
-		unwrappedBuf, err = t.saslClient.Decode(rawBuf)
-		if err != nil {
-			return
+	// Without a security layer the payload is read straight from the
+	// underlying transport into p.
+	if !securityLayer {
+		if len(p) > t.frameSize {
+			p = p[:t.frameSize]
 		}
-		t.frameSize = len(unwrappedBuf)
-		t.readBuf.Write(unwrappedBuf)
+		n, err = t.tp.Read(p)
+		t.frameSize -= n
+		return n, thrift.NewTTransportExceptionFromError(err)
+	}
+
+	n = copy(p, t.readBuf)
+	t.readBuf = t.readBuf[n:]
+	t.frameSize -= n
+	if t.frameSize == 0 {
+		t.releaseFrame()
+	}
+	return n, nil
+}
+
+// readWrappedFrame decodes the next frame in place; readBuf may point into
+// rawBuf, which is kept until the frame has been read.
+func (t *TSaslTransport) readWrappedFrame(size uint32) error {
+	t.releaseFrame()
+	t.rawBuf = getFrameBuffer(int(size))
+	if _, err := io.ReadFull(t.tp, *t.rawBuf); err != nil {
+		t.releaseFrame()
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	unwrappedBuf, err := t.saslClient.Decode(*t.rawBuf)
+	if err != nil {
+		t.releaseFrame()
+		return thrift.NewTTransportExceptionFromError(err)
 	}
 
-	got, err = t.readBuf.Read(p)
-	t.frameSize = t.frameSize - got
+	t.readBuf = unwrappedBuf
+	t.frameSize = len(unwrappedBuf)
+	if t.frameSize == 0 {
+		t.releaseFrame()
+	}
+	return nil
+}
 
-	if t.frameSize < 0 {
-		return 0, thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION, "Negative frame size")
+func (t *TSaslTransport) releaseFrame() {
+	if t.rawBuf != nil {
+		putFrameBuffer(t.rawBuf)
+		t.rawBuf = nil
 	}
-	return got, thrift.NewTTransportExceptionFromError(err)
+	t.readBuf = nil
 }
 
 func (t *TSaslTransport) RemainingBytes() uint64 {
@@ -197,23 +410,27 @@ func (t *TSaslTransport) sendSaslMsg(ctx context.Context, stat uint8, msg []byte
 	return
 }
 
-func (t *TSaslTransport) recvSaslMsg(ctx context.Context) (s int8, b []byte) {
+func (t *TSaslTransport) recvSaslMsg(ctx context.Context) (s int8, b []byte, err error) {
 	h := make([]byte, 5)
-	if _, err := io.ReadFull(t.tp, h); err != nil {
-		return ERROR, nil
+	if _, err = io.ReadFull(t.tp, h); err != nil {
+		return ERROR, nil, thrift.NewTTransportExceptionFromError(err)
 	}
 
 	s = int8(h[0])
 	l := binary.BigEndian.Uint32(h[1:])
+	if l > t.maxLength {
+		return ERROR, nil, thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION,
+			fmt.Sprintf("SASL message is bigger than allowed, set configuration.MaxLength (%d)", l))
+	}
 
 	if l > 0 {
 		p := make([]byte, l)
-		if _, err := io.ReadFull(t.tp, p); err != nil {
-			return ERROR, nil
+		if _, err = io.ReadFull(t.tp, p); err != nil {
+			return ERROR, nil, thrift.NewTTransportExceptionFromError(err)
 		}
-		return s, p
+		return s, p, nil
 	}
-	return s, nil
+	return s, nil, nil
 }
 
 func (t *TSaslTransport) readFrameHeader() (size uint32, err error) {
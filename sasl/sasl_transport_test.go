@@ -0,0 +1,378 @@
+package sasl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryTransport reads frames from in and writes everything to out. With
+// block set, reads past in wait until the transport is closed.
+type memoryTransport struct {
+	in    bytes.Buffer
+	out   io.Writer
+	block chan struct{}
+	once  sync.Once
+}
+
+func (t *memoryTransport) Open() error  { return nil }
+func (t *memoryTransport) IsOpen() bool { return true }
+
+func (t *memoryTransport) Close() error {
+	if t.block != nil {
+		t.once.Do(func() { close(t.block) })
+	}
+	return nil
+}
+
+func (t *memoryTransport) Read(p []byte) (int, error) {
+	if t.in.Len() == 0 && t.block != nil {
+		<-t.block
+		return 0, io.ErrClosedPipe
+	}
+	return t.in.Read(p)
+}
+
+func (t *memoryTransport) Write(p []byte) (int, error)     { return t.out.Write(p) }
+func (t *memoryTransport) Flush(ctx context.Context) error { return nil }
+func (t *memoryTransport) RemainingBytes() uint64          { return uint64(t.in.Len()) }
+
+func (t *memoryTransport) writeFrame(payload []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	t.in.Write(size[:])
+	t.in.Write(payload)
+}
+
+func (t *memoryTransport) writeSaslMsg(status byte, payload string) {
+	t.in.Write(saslMsg(status, payload))
+}
+
+// saslMsg is a negotiation message as sent on the wire.
+func saslMsg(status byte, payload string) []byte {
+	msg := append([]byte{status}, binary.BigEndian.AppendUint32(nil, uint32(len(payload)))...)
+	return append(msg, payload...)
+}
+
+func TestTSaslTransportSingleMessageMechanisms(t *testing.T) {
+	tests := []struct {
+		mechanism     string
+		configuration map[string]string
+		response      string
+	}{
+		{mechanism: "ANONYMOUS", configuration: map[string]string{"trace": "bob@example.com"}, response: "bob@example.com"},
+		{mechanism: "ANONYMOUS", configuration: map[string]string{}, response: ""},
+		{mechanism: "EXTERNAL", configuration: map[string]string{"authzid": "alice"}, response: "alice"},
+		{mechanism: "EXTERNAL", configuration: map[string]string{}, response: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.mechanism+"/"+test.response, func(t *testing.T) {
+			var written bytes.Buffer
+			mt := &memoryTransport{out: &written}
+			mt.writeSaslMsg(COMPLETE, "")
+			transport := NewTSaslTransport(mt, "localhost", test.mechanism, test.configuration, testMaxLength)
+			if err := transport.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if !transport.IsOpen() {
+				t.Error("not open after COMPLETE")
+			}
+			want := append(saslMsg(START, test.mechanism), saslMsg(OK, test.response)...)
+			if !bytes.Equal(written.Bytes(), want) {
+				t.Errorf("sent %q, want %q", written.Bytes(), want)
+			}
+
+			// No security layer, frames are sent as they are.
+			written.Reset()
+			transport.Write([]byte("ping"))
+			if err := transport.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written.Bytes(), append([]byte{0, 0, 0, 4}, "ping"...)) {
+				t.Errorf("sent %q", written.Bytes())
+			}
+		})
+	}
+}
+
+func TestTSaslTransportOpenContextDone(t *testing.T) {
+	tests := map[string]func() (context.Context, context.CancelFunc){
+		"deadline": func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		},
+		"cancel": func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		},
+	}
+	for name, newContext := range tests {
+		t.Run(name, func(t *testing.T) {
+			var written bytes.Buffer
+			mt := &memoryTransport{out: &written, block: make(chan struct{})}
+			// The server asks for another step and then never answers.
+			mt.writeSaslMsg(OK, "")
+			transport := NewTSaslTransport(mt, "localhost", "PLAIN",
+				map[string]string{"username": "bob", "password": "secret"}, testMaxLength)
+
+			ctx, cancel := newContext()
+			defer cancel()
+			err := transport.OpenContext(ctx)
+			if !errors.Is(err, ctx.Err()) || ctx.Err() == nil {
+				t.Fatalf("expected %v, got %v", ctx.Err(), err)
+			}
+			select {
+			case <-mt.block:
+			default:
+				t.Error("the transport was not closed")
+			}
+		})
+	}
+
+	// A context done before the negotiation sends nothing.
+	var written bytes.Buffer
+	transport := NewTSaslTransport(&memoryTransport{out: &written}, "localhost", "PLAIN",
+		map[string]string{"username": "bob", "password": "secret"}, testMaxLength)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := transport.OpenContext(ctx); !errors.Is(err, context.Canceled) || written.Len() > 0 {
+		t.Errorf("%v after writing %q", err, written.Bytes())
+	}
+}
+
+func TestTSaslTransportServerFailure(t *testing.T) {
+	for _, status := range []int8{BAD, ERROR} {
+		var written bytes.Buffer
+		mt := &memoryTransport{out: &written}
+		mt.writeSaslMsg(byte(status), "Error validating the login")
+		transport := NewTSaslTransport(mt, "localhost", "PLAIN",
+			map[string]string{"username": "bob", "password": "wrong"}, testMaxLength)
+
+		var negotiationErr *SaslNegotiationError
+		if err := transport.Open(); !errors.As(err, &negotiationErr) {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		if negotiationErr.Status != status || negotiationErr.Message != "Error validating the login" {
+			t.Errorf("status %d, message %q", negotiationErr.Status, negotiationErr.Message)
+		}
+		if !strings.Contains(negotiationErr.Error(), "Error validating the login") {
+			t.Errorf("error %q", negotiationErr.Error())
+		}
+	}
+}
+
+// newDigestMD5Pair returns a client mechanism with an established security
+// layer and the matching server side, which has the keys swapped.
+func newDigestMD5Pair(qop string) (client, server *DigestMD5Mechanism) {
+	newMechanism := func() *DigestMD5Mechanism {
+		m := NewDigestMD5Mechanism("hive", "bob", "secret")
+		m.auth = qop
+		if qop == AUTH_CONF {
+			m.cipher = "rc4"
+		}
+		m.keyHash, m.nonce, m.cnonce = "key", "nonce", "cnonce"
+		m.securityLayer()
+		return m
+	}
+	client, server = newMechanism(), newMechanism()
+	server.sendMAC, server.recvMAC = server.recvMAC, server.sendMAC
+	server.sendCipher, server.recvCipher = server.recvCipher, server.sendCipher
+	return client, server
+}
+
+func TestTSaslTransportSecurityLayer(t *testing.T) {
+	for _, qop := range []string{AUTH_INT, AUTH_CONF} {
+		t.Run(qop, func(t *testing.T) {
+			client, server := newDigestMD5Pair(qop)
+			var written bytes.Buffer
+			mt := &memoryTransport{out: &written}
+			transport := NewTSaslTransportWithMechanism(mt, "localhost", client, testMaxLength)
+
+			messages := []string{"first", "", "second message"}
+			for _, message := range messages {
+				wrapped, err := server.encode([]byte(message))
+				if err != nil {
+					t.Fatal(err)
+				}
+				mt.writeFrame(wrapped)
+			}
+			for _, message := range messages {
+				if message == "" {
+					continue
+				}
+				buf := make([]byte, len(message))
+				if _, err := io.ReadFull(transport, buf); err != nil || string(buf) != message {
+					t.Fatalf("read %q, %v, want %q", buf, err, message)
+				}
+			}
+
+			transport.Write([]byte("reply"))
+			if err := transport.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			frame := written.Bytes()
+			if len(frame) < 4 || int(binary.BigEndian.Uint32(frame)) != len(frame)-4 {
+				t.Fatalf("malformed frame %x", frame)
+			}
+			reply, err := server.decode(frame[4:])
+			if err != nil || string(reply) != "reply" {
+				t.Fatalf("decoded %q, %v", reply, err)
+			}
+
+			// A replayed frame is out of sequence.
+			if _, err := server.decode(frame[4:]); err == nil {
+				t.Error("expected the replayed frame to be rejected")
+			}
+		})
+	}
+}
+
+func TestTSaslTransportFlushSplitsFrames(t *testing.T) {
+	client, server := newDigestMD5Pair(AUTH_INT)
+	client.mechanismConfig.rawSendSize = 10
+	var written bytes.Buffer
+	transport := NewTSaslTransportWithMechanism(&memoryTransport{out: &written}, "localhost", client, testMaxLength)
+
+	transport.Write([]byte("0123456789abcdefghijKLMNO"))
+	if err := transport.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for written.Len() > 0 {
+		size := binary.BigEndian.Uint32(written.Next(4))
+		frame := written.Next(int(size))
+		if len(frame) > 10+DIGEST_TRAILER_LENGTH {
+			t.Errorf("frame of %d bytes", len(frame))
+		}
+		chunk, err := server.decode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(chunk))
+	}
+	if strings.Join(chunks, "|") != "0123456789|abcdefghij|KLMNO" {
+		t.Errorf("frames %q", chunks)
+	}
+}
+
+func TestDigestMD5AdvertisesMaxLength(t *testing.T) {
+	challenge := []byte(`realm="EXAMPLE",nonce="abc",qop="auth-int",charset=utf-8,algorithm=md5-sess`)
+	for _, test := range []struct {
+		maxLength uint32
+		want      string
+	}{
+		{maxLength: 4096, want: ",maxbuf=4096"},
+		{maxLength: 1 << 30, want: ",maxbuf=16777215"},
+	} {
+		m := NewDigestMD5Mechanism("hive", "bob", "secret")
+		NewTSaslTransportWithMechanism(&memoryTransport{out: io.Discard}, "localhost", m, test.maxLength)
+		response, err := m.step(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(response), test.want) {
+			t.Errorf("maxLength %d: %s", test.maxLength, response)
+		}
+	}
+}
+
+func TestTSaslTransportRejectsTamperedFrame(t *testing.T) {
+	client, server := newDigestMD5Pair(AUTH_INT)
+	mt := &memoryTransport{out: io.Discard}
+	transport := NewTSaslTransportWithMechanism(mt, "localhost", client, testMaxLength)
+
+	wrapped, _ := server.encode([]byte("message"))
+	wrapped[0] ^= 0xff
+	mt.writeFrame(wrapped)
+	if _, err := transport.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected the integrity check to fail")
+	}
+}
+
+func TestNewTSaslTransportInvalidQop(t *testing.T) {
+	mt := &memoryTransport{out: io.Discard}
+	transport := NewTSaslTransport(mt, "localhost", "DIGEST-MD5",
+		map[string]string{"username": "bob", "password": "secret", "qop": "auth-none"}, testMaxLength)
+	if err := transport.Open(); err == nil || !strings.Contains(err.Error(), "auth-none") {
+		t.Fatalf("expected an unknown qop error, got %v", err)
+	}
+}
+
+const benchmarkMessageSize = 4096
+
+func benchmarkRead(b *testing.B, transport *TSaslTransport, mt *memoryTransport, encode func([]byte) ([]byte, error)) {
+	message := bytes.Repeat([]byte("x"), benchmarkMessageSize)
+	buf := make([]byte, benchmarkMessageSize)
+	b.SetBytes(benchmarkMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if mt.in.Len() == 0 {
+			b.StopTimer()
+			mt.in.Reset()
+			for j := 0; j < 1024; j++ {
+				wrapped, err := encode(message)
+				if err != nil {
+					b.Fatal(err)
+				}
+				mt.writeFrame(wrapped)
+			}
+			b.StartTimer()
+		}
+		if _, err := io.ReadFull(transport, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkFlush(b *testing.B, transport *TSaslTransport) {
+	message := bytes.Repeat([]byte("x"), benchmarkMessageSize)
+	ctx := context.Background()
+	b.SetBytes(benchmarkMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport.Write(message)
+		if err := transport.Flush(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	b.Run("plain", func(b *testing.B) {
+		mt := &memoryTransport{out: io.Discard}
+		transport := NewTSaslTransport(mt, "localhost", "PLAIN", map[string]string{}, testMaxLength)
+		benchmarkRead(b, transport, mt, func(message []byte) ([]byte, error) {
+			return message, nil
+		})
+	})
+	for _, qop := range []string{AUTH_INT, AUTH_CONF} {
+		b.Run(qop, func(b *testing.B) {
+			client, server := newDigestMD5Pair(qop)
+			mt := &memoryTransport{out: io.Discard}
+			transport := NewTSaslTransportWithMechanism(mt, "localhost", client, testMaxLength)
+			benchmarkRead(b, transport, mt, server.encode)
+		})
+	}
+}
+
+func BenchmarkFlush(b *testing.B) {
+	b.Run("plain", func(b *testing.B) {
+		mt := &memoryTransport{out: io.Discard}
+		benchmarkFlush(b, NewTSaslTransport(mt, "localhost", "PLAIN", map[string]string{}, testMaxLength))
+	})
+	for _, qop := range []string{AUTH_INT, AUTH_CONF} {
+		b.Run(qop, func(b *testing.B) {
+			client, _ := newDigestMD5Pair(qop)
+			mt := &memoryTransport{out: io.Discard}
+			benchmarkFlush(b, NewTSaslTransportWithMechanism(mt, "localhost", client, testMaxLength))
+		})
+	}
+}
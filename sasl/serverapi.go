@@ -0,0 +1,164 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PlainAuthenticator verifies the credentials sent with PLAIN. authzid is
+// empty when the client does not ask to act as another identity.
+type PlainAuthenticator func(authzid, username, password string) error
+
+// DigestPasswordLookup returns the password of username in realm for
+// DIGEST-MD5, which needs it to compute the expected response.
+type DigestPasswordLookup func(username, realm string) (string, error)
+
+type PlainServerMechanism struct {
+	authenticate    PlainAuthenticator
+	authorizationID string
+}
+
+func NewPlainServerMechanism(authenticate PlainAuthenticator) *PlainServerMechanism {
+	return &PlainServerMechanism{authenticate: authenticate}
+}
+
+// PlainServerMechanismFactory registers PLAIN with TSaslServerTransport.
+func PlainServerMechanismFactory(authenticate PlainAuthenticator) ServerMechanismFactory {
+	return func() ServerMechanism {
+		return NewPlainServerMechanism(authenticate)
+	}
+}
+
+func (p *PlainServerMechanism) Name() string {
+	return "PLAIN"
+}
+
+func (p *PlainServerMechanism) Step(response []byte) ([]byte, bool, error) {
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 || len(fields[1]) == 0 {
+		return nil, false, fmt.Errorf("malformed PLAIN response")
+	}
+	authzid, username, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if err := p.authenticate(authzid, username, password); err != nil {
+		return nil, false, err
+	}
+
+	p.authorizationID = username
+	if authzid != "" {
+		p.authorizationID = authzid
+	}
+	return nil, true, nil
+}
+
+func (p *PlainServerMechanism) AuthorizationID() string {
+	return p.authorizationID
+}
+
+// DigestMD5ServerMechanism implements RFC 2831 with the auth qop only.
+type DigestMD5ServerMechanism struct {
+	service         string
+	realm           string
+	lookup          DigestPasswordLookup
+	nonce           string
+	challenged      bool
+	authorizationID string
+}
+
+func NewDigestMD5ServerMechanism(service, realm string, lookup DigestPasswordLookup) *DigestMD5ServerMechanism {
+	return &DigestMD5ServerMechanism{
+		service: service,
+		realm:   realm,
+		lookup:  lookup,
+	}
+}
+
+// DigestMD5ServerMechanismFactory registers DIGEST-MD5 with
+// TSaslServerTransport.
+func DigestMD5ServerMechanismFactory(service, realm string, lookup DigestPasswordLookup) ServerMechanismFactory {
+	return func() ServerMechanism {
+		return NewDigestMD5ServerMechanism(service, realm, lookup)
+	}
+}
+
+func (m *DigestMD5ServerMechanism) Name() string {
+	return "DIGEST-MD5"
+}
+
+func (m *DigestMD5ServerMechanism) Step(response []byte) ([]byte, bool, error) {
+	if !m.challenged {
+		nonce := make([]byte, 18)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, false, err
+		}
+		m.challenged = true
+		m.nonce = base64.StdEncoding.EncodeToString(nonce)
+		challenge := "realm=" + strconv.Quote(m.realm) + ",nonce=" + strconv.Quote(m.nonce) +
+			",qop=\"auth\",charset=utf-8,algorithm=md5-sess"
+		return []byte(challenge), false, nil
+	}
+
+	if len(response) == 0 {
+		return nil, false, fmt.Errorf("empty DIGEST-MD5 response")
+	}
+	r, err := parseDirectives(response)
+	if err != nil {
+		return nil, false, err
+	}
+	if r["nonce"] != m.nonce {
+		return nil, false, fmt.Errorf("DIGEST-MD5 nonce mismatch")
+	}
+	if r["realm"] != m.realm {
+		return nil, false, fmt.Errorf("DIGEST-MD5 realm mismatch")
+	}
+	if qop := r["qop"]; qop != "" && qop != AUTH {
+		return nil, false, fmt.Errorf("unsupported DIGEST-MD5 qop %s", qop)
+	}
+	if r["nc"] != "00000001" {
+		return nil, false, fmt.Errorf("unexpected DIGEST-MD5 nonce count %s", r["nc"])
+	}
+	if !strings.HasPrefix(r["digest-uri"], m.service+"/") {
+		return nil, false, fmt.Errorf("DIGEST-MD5 digest-uri %s does not match service %s", r["digest-uri"], m.service)
+	}
+
+	password, err := m.lookup(r["username"], m.realm)
+	if err != nil {
+		return nil, false, err
+	}
+
+	expected := digestResponseValue(r, m.realm, password, "AUTHENTICATE:"+r["digest-uri"])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(r["response"]))) != 1 {
+		return nil, false, fmt.Errorf("authentication error")
+	}
+
+	m.authorizationID = r["username"]
+	if r["authzid"] != "" {
+		m.authorizationID = r["authzid"]
+	}
+	rspauth := digestResponseValue(r, m.realm, password, ":"+r["digest-uri"])
+	return []byte("rspauth=" + rspauth), true, nil
+}
+
+func (m *DigestMD5ServerMechanism) AuthorizationID() string {
+	return m.authorizationID
+}
+
+func digestResponseValue(r map[string]string, realm, password, a2String string) string {
+	keyHash := md5.Sum([]byte(r["username"] + ":" + realm + ":" + password))
+	a1String := []string{string(keyHash[:]), r["nonce"], r["cnonce"]}
+	if r["authzid"] != "" {
+		a1String = append(a1String, r["authzid"])
+	}
+
+	h1 := md5.Sum([]byte(strings.Join(a1String, ":")))
+	h2 := md5.Sum([]byte(a2String))
+	hr := md5.Sum([]byte(hex.EncodeToString(h1[:]) + ":" + r["nonce"] + ":" + r["nc"] + ":" +
+		r["cnonce"] + ":" + AUTH + ":" + hex.EncodeToString(h2[:])))
+	return hex.EncodeToString(hr[:])
+}
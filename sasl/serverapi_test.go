@@ -0,0 +1,61 @@
+package sasl
+
+import (
+	"testing"
+)
+
+func TestParseDirectives(t *testing.T) {
+	c, err := parseDirectives([]byte(`realm="a",realm="b", nonce="x\"y" ,qop="auth,auth-int",maxbuf=65536,,charset=utf-8`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"realm":   "a",
+		"nonce":   `x"y`,
+		"qop":     "auth,auth-int",
+		"maxbuf":  "65536",
+		"charset": "utf-8",
+	}
+	if len(c) != len(want) {
+		t.Fatalf("got %v, want %v", c, want)
+	}
+	for k, v := range want {
+		if c[k] != v {
+			t.Errorf("%s = %q, want %q", k, c[k], v)
+		}
+	}
+}
+
+var malformedDigestResponses = []string{
+	"username",
+	"=value",
+	"username=",
+	`username="bob`,
+	`username="bob\`,
+	`username="bob"nonce="x"`,
+	"username=bob,username=alice",
+	"user name=bob",
+	`username=b"ob`,
+	"a=b,c",
+}
+
+func TestParseDirectivesMalformed(t *testing.T) {
+	for _, response := range malformedDigestResponses {
+		if c, err := parseDirectives([]byte(response)); err == nil {
+			t.Errorf("%q: expected an error, got %v", response, c)
+		}
+	}
+}
+
+func TestDigestMD5ServerMechanismMalformedResponse(t *testing.T) {
+	lookup := func(username, realm string) (string, error) { return "secret", nil }
+	for _, response := range malformedDigestResponses {
+		m := NewDigestMD5ServerMechanism("hive", "EXAMPLE", lookup)
+		if _, _, err := m.Step(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, complete, err := m.Step([]byte(response)); err == nil || complete {
+			t.Errorf("%q: expected an error", response)
+		}
+	}
+}
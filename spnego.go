@@ -0,0 +1,180 @@
+package hiveconnect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	sasl "github.com/Galzzly/hiveconnect/sasl"
+	"github.com/pkg/errors"
+)
+
+// spnegoTransport authenticates HTTP requests with Kerberos. Requests that
+// carry the auth cookie are sent as they are, every other request gets a
+// fresh Negotiate token. A 401 asking for Negotiate is retried once with a
+// new token.
+//
+// With a peer the tokens carry the channel binding of its certificate. Until
+// a connection has been made the request is sent without a token, and the
+// 401 is retried once the certificate is known.
+type spnegoTransport struct {
+	next         http.RoundTripper
+	host         string
+	cookieName   string
+	peer         *tlsPeer
+	newMechanism func() *sasl.GSSAPIMechanism
+}
+
+// newSpnegoTransport authenticates the requests of base, binding the tokens
+// to the server certificate over TLS unless DisableKerberosChannelBinding is
+// set.
+func newSpnegoTransport(base *http.Transport, configuration *ConnectionConfiguration, login *sasl.KerberosLogin,
+	host, cookieName string) *spnegoTransport {
+	var peer *tlsPeer
+	if !configuration.DisableKerberosChannelBinding && configuration.TLSConfig != nil {
+		peer = &tlsPeer{}
+		base.TLSClientConfig = peer.watch(base.TLSClientConfig)
+	}
+	return &spnegoTransport{
+		next:       base,
+		host:       host,
+		cookieName: cookieName,
+		peer:       peer,
+		newMechanism: func() *sasl.GSSAPIMechanism {
+			return newGSSAPIMechanism(configuration, login)
+		},
+	}
+}
+
+func (t *spnegoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A rejected cookie is dealt with by the cookieTransport above.
+	if hasCookie(req, t.cookieName) {
+		return t.roundTrip(req, false)
+	}
+
+	resp, err := t.roundTrip(req, t.peer == nil || t.peer.connected())
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !negotiateRequested(resp) {
+		return resp, err
+	}
+	retry, err := retryRequest(req, resp)
+	if retry == nil || err != nil {
+		return resp, err
+	}
+	return t.roundTrip(retry, true)
+}
+
+func (t *spnegoTransport) roundTrip(req *http.Request, withToken bool) (*http.Response, error) {
+	if !withToken {
+		return t.next.RoundTrip(req)
+	}
+
+	mechanism := t.newMechanism()
+	if t.peer != nil {
+		channelBinding, err := t.peer.channelBinding()
+		if err != nil {
+			return nil, err
+		}
+		mechanism.ChannelBinding = channelBinding
+	}
+	saslClient := sasl.NewSaslClient(t.host, mechanism)
+	defer saslClient.Dispose()
+
+	token, err := saslClient.Start()
+	if err != nil {
+		return nil, err
+	}
+	if len(token) == 0 {
+		return nil, errors.New("Empty token returned. Service configuration may be empty")
+	}
+
+	req = withHeader(req, "Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusUnauthorized {
+		return resp, err
+	}
+
+	serverToken, err := negotiateToken(resp)
+	if err == nil && serverToken != nil {
+		if _, err = saslClient.Step(serverToken); err == nil && !mechanism.ContextEstablished() {
+			err = errors.New("the server requested another round trip")
+		}
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to verify the server's Negotiate response: %v", err)
+	}
+	return resp, nil
+}
+
+func negotiateRequested(resp *http.Response) bool {
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		if scheme, _, _ := strings.Cut(challenge, " "); strings.EqualFold(scheme, "Negotiate") {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateToken returns the mutual authentication token the server sent
+// back, if any.
+func negotiateToken(resp *http.Response) ([]byte, error) {
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		scheme, data, _ := strings.Cut(challenge, " ")
+		if !strings.EqualFold(scheme, "Negotiate") {
+			continue
+		}
+		if data = strings.TrimSpace(data); data == "" {
+			return nil, nil
+		}
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return nil, nil
+}
+
+// tlsPeer records the certificate of the server the HTTP client last
+// connected to.
+type tlsPeer struct {
+	mu          sync.Mutex
+	certificate *x509.Certificate
+}
+
+// watch returns a copy of config that records the server certificate.
+func (p *tlsPeer) watch(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if len(state.PeerCertificates) > 0 {
+			p.mu.Lock()
+			p.certificate = state.PeerCertificates[0]
+			p.mu.Unlock()
+		}
+		return nil
+	}
+	return config
+}
+
+func (p *tlsPeer) connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.certificate != nil
+}
+
+func (p *tlsPeer) channelBinding() ([]byte, error) {
+	p.mu.Lock()
+	certificate := p.certificate
+	p.mu.Unlock()
+	if certificate == nil {
+		return nil, errors.New("the server did not present a certificate for channel binding")
+	}
+	return sasl.TLSServerEndPoint(certificate)
+}
@@ -0,0 +1,181 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sasl "github.com/Galzzly/hiveconnect/sasl"
+	"github.com/pkg/errors"
+)
+
+var errTestRejected = errors.New("certificate rejected")
+
+func TestSpnegoTransportChannelBinding(t *testing.T) {
+	var requests, withToken int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Negotiate ZmFrZS10b2tlbi0w" {
+			w.Header().Set("WWW-Authenticate", "Negotiate")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		withToken++
+	}))
+	defer server.Close()
+
+	base := server.Client().Transport.(*http.Transport)
+	peer := &tlsPeer{}
+	base.TLSClientConfig = peer.watch(base.TLSClientConfig)
+	var provider *sasl.FakeGSSAPIProvider
+	transport := &spnegoTransport{
+		next: base,
+		host: "localhost",
+		peer: peer,
+		newMechanism: func() *sasl.GSSAPIMechanism {
+			provider = &sasl.FakeGSSAPIProvider{}
+			return sasl.NewGSSAPIMechanismWithProvider("hive", provider)
+		},
+	}
+
+	want, err := sasl.TLSServerEndPoint(server.Certificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("message"))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(resp.Status)
+		}
+		if !bytes.Equal(provider.ChannelBinding, want) {
+			t.Errorf("channel binding %x, want %x", provider.ChannelBinding, want)
+		}
+	}
+	// The first request establishes the connection without a token.
+	if requests != 3 || withToken != 2 {
+		t.Errorf("%d requests, %d with a token", requests, withToken)
+	}
+}
+
+func TestTLSPeerKeepsVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	peer := &tlsPeer{}
+	config := peer.watch(&tls.Config{InsecureSkipVerify: true, VerifyConnection: func(tls.ConnectionState) error {
+		return errTestRejected
+	}})
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), errTestRejected.Error()) {
+		t.Fatalf("expected the connection to be rejected, got %v", err)
+	}
+	if peer.connected() {
+		t.Error("a rejected certificate was recorded")
+	}
+}
+
+func TestNewSpnegoTransportChannelBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     bool
+		disable bool
+		bound   bool
+	}{
+		{name: "TLS", tls: true, bound: true},
+		{name: "disabled", tls: true, disable: true},
+		{name: "plain HTTP"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConnectionConfiguration()
+			configuration.DisableKerberosChannelBinding = test.disable
+			if test.tls {
+				configuration.TLSConfig = &tls.Config{ServerName: "hs2.example.com"}
+			}
+			base := &http.Transport{TLSClientConfig: configuration.TLSConfig}
+			transport := newSpnegoTransport(base, configuration, nil, "hs2.example.com", DEFAULT_COOKIE_NAME)
+			if (transport.peer != nil) != test.bound {
+				t.Errorf("channel binding %v", transport.peer != nil)
+			}
+			if test.bound && (base.TLSClientConfig.VerifyConnection == nil || base.TLSClientConfig.ServerName != "hs2.example.com") {
+				t.Error("the TLS configuration does not record the peer")
+			}
+		})
+	}
+}
+
+func TestSpnegoTransportMutualAuthentication(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []string
+		requests  int
+		ok        bool
+	}{
+		{name: "verified", responses: []string{"Negotiate c2VydmVyLXRva2Vu"}, requests: 1, ok: true},
+		{name: "no token", responses: []string{""}, requests: 1, ok: true},
+		// A replayed token is refused, the retry gets a fresh one.
+		{name: "retry", responses: []string{"401 Negotiate", "Negotiate c2VydmVyLXRva2Vu"}, requests: 2, ok: true},
+		{name: "other scheme", responses: []string{"401 Basic realm=\"hive\""}, requests: 1, ok: true},
+		{name: "forged token", responses: []string{"Negotiate Zm9yZ2Vk"}, requests: 1},
+		{name: "bad encoding", responses: []string{"Negotiate !!!"}, requests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tokens []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokens = append(tokens, r.Header.Get("Authorization"))
+				response := test.responses[len(tokens)-1]
+				if challenge := strings.TrimPrefix(response, "401 "); challenge != response {
+					w.Header().Set("WWW-Authenticate", challenge)
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				if response != "" {
+					w.Header().Set("WWW-Authenticate", response)
+				}
+			}))
+			defer server.Close()
+
+			var providers []*sasl.FakeGSSAPIProvider
+			transport := &spnegoTransport{
+				next: http.DefaultTransport,
+				host: "hs2.example.com",
+				newMechanism: func() *sasl.GSSAPIMechanism {
+					provider := &sasl.FakeGSSAPIProvider{ServerToken: []byte("server-token")}
+					providers = append(providers, provider)
+					return sasl.NewGSSAPIMechanismWithProvider("HTTP", provider)
+				},
+			}
+			req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("message"))
+			resp, err := transport.RoundTrip(req)
+			if test.ok != (err == nil) {
+				t.Fatalf("%v", err)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if len(tokens) != test.requests || len(providers) != test.requests {
+				t.Fatalf("%d requests with %d tokens", len(tokens), len(providers))
+			}
+			for i, token := range tokens {
+				if token != "Negotiate ZmFrZS10b2tlbi0w" {
+					t.Errorf("request %d: %q", i, token)
+				}
+			}
+			for _, provider := range providers {
+				if !provider.Disposed {
+					t.Error("a mechanism was not disposed")
+				}
+			}
+		})
+	}
+}
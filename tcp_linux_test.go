@@ -0,0 +1,135 @@
+package hiveconnect
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt reads an integer socket option of conn.
+func sockopt(t *testing.T, conn net.Conn, level, option int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err = raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func localListener(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTCPDialerOptions(t *testing.T) {
+	addr := localListener(t)
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		noDelay   bool
+		wantAlive int
+		wantIdle  int
+		wantDelay int
+	}{
+		{name: "keep-alive", keepAlive: 42 * time.Second, wantAlive: 1, wantIdle: 42, wantDelay: 1},
+		{name: "no keep-alive", keepAlive: -1, noDelay: true, wantAlive: 0, wantDelay: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConnectionConfiguration()
+			configuration.TCPKeepAlive = test.keepAlive
+			configuration.DisableTCPNoDelay = test.noDelay
+			conn, err := dialContext(configuration)(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if alive := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); alive != test.wantAlive {
+				t.Errorf("SO_KEEPALIVE %d", alive)
+			}
+			if test.wantIdle > 0 {
+				if idle := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != test.wantIdle {
+					t.Errorf("TCP_KEEPIDLE %d", idle)
+				}
+			}
+			if noDelay := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); noDelay != test.wantDelay {
+				t.Errorf("TCP_NODELAY %d", noDelay)
+			}
+		})
+	}
+}
+
+// The connections of DialContext, such as the ones of a proxy, are its own.
+func TestCustomDialContextUntouched(t *testing.T) {
+	proxyURL, _ := fakeConnectProxy(t, "HTTP/1.1 200 Connection established\r\n\r\n")
+	tests := map[string]DialContextFunc{
+		"custom": (&net.Dialer{}).DialContext,
+		"proxy":  NewHTTPConnectDialer(proxyURL),
+	}
+	addr := localListener(t)
+	for name, dial := range tests {
+		t.Run(name, func(t *testing.T) {
+			configuration := NewConnectionConfiguration()
+			configuration.DialContext = dial
+			configuration.TCPKeepAlive = -1
+			configuration.DisableTCPNoDelay = true
+			conn, err := dialContext(configuration)(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if alive := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); alive != 1 {
+				t.Errorf("SO_KEEPALIVE %d", alive)
+			}
+			if noDelay := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); noDelay != 1 {
+				t.Errorf("TCP_NODELAY %d", noDelay)
+			}
+		})
+	}
+}
+
+func TestDialContextConnectTimeout(t *testing.T) {
+	configuration := NewConnectionConfiguration()
+	configuration.ConnectTimeout = 50 * time.Millisecond
+	configuration.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) > configuration.ConnectTimeout {
+			t.Errorf("dial deadline %v, %v", deadline, ok)
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	if _, err := dialContext(configuration)(context.Background(), "tcp", "hs2.example.com:10000"); err != context.DeadlineExceeded {
+		t.Errorf("expected the dial to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the dial took %v", elapsed)
+	}
+}
@@ -0,0 +1,113 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const SPKI_PIN_PREFIX = "sha256/"
+
+// tlsPin is the SHA-256 hash of either a certificate or its public key.
+type tlsPin struct {
+	spki bool
+	hash []byte
+}
+
+// parseTLSPin accepts sha256/<base64> for the hash of a public key, as
+// printed by openssl and used by HPKP, and the hex SHA-256 fingerprint of a
+// certificate, with or without colons.
+func parseTLSPin(pin string) (tlsPin, error) {
+	var err error
+	var p tlsPin
+	if strings.HasPrefix(pin, SPKI_PIN_PREFIX) {
+		p.spki = true
+		p.hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, SPKI_PIN_PREFIX))
+	} else {
+		p.hash, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(p.hash) != sha256.Size {
+		return p, errors.Errorf("invalid TLS pin %s", pin)
+	}
+	return p, nil
+}
+
+func (p tlsPin) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if p.spki {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	hash := sha256.Sum256(data)
+	return bytes.Equal(hash[:], p.hash)
+}
+
+// configureVerification applies the server name, hostname verification and
+// pinning settings of configuration to tlsConfig.
+func configureVerification(tlsConfig *tls.Config, configuration *ConnectionConfiguration) error {
+	if configuration.TLSServerName != "" {
+		tlsConfig.ServerName = configuration.TLSServerName
+	}
+
+	var pins []tlsPin
+	for _, pin := range configuration.TLSPins {
+		p, err := parseTLSPin(pin)
+		if err != nil {
+			return err
+		}
+		pins = append(pins, p)
+	}
+
+	// The chain is still verified without the hostname, unless the caller
+	// disabled verification altogether.
+	verifyChain := configuration.DisableHostnameVerification && !tlsConfig.InsecureSkipVerify
+	if configuration.DisableHostnameVerification {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if !verifyChain && len(pins) == 0 {
+		return nil
+	}
+
+	roots := tlsConfig.RootCAs
+	next := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("the server did not present a certificate")
+		}
+		if verifyChain {
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+				return err
+			}
+		}
+		if len(pins) > 0 && !pinned(state.PeerCertificates, pins) {
+			return errors.New("the server certificate does not match any TLS pin")
+		}
+		if next != nil {
+			return next(state)
+		}
+		return nil
+	}
+	return nil
+}
+
+// pinned reports whether any certificate of the chain matches a pin, so that
+// an intermediate or root can be pinned as well as the server certificate.
+func pinned(certs []*x509.Certificate, pins []tlsPin) bool {
+	for _, cert := range certs {
+		for _, pin := range pins {
+			if pin.matches(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
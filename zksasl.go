@@ -0,0 +1,203 @@
+package hiveconnect
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+
+	sasl "github.com/Galzzly/hiveconnect/sasl"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// zkOpSasl is the opcode of SASL requests, which the ZooKeeper client
+	// defines but never sends.
+	zkOpSasl = 102
+	// zkDigestServerName is the server name of DIGEST-MD5, ZooKeeper does not
+	// use the host for it.
+	zkDigestServerName = "zk-sasl-md5"
+	// zkMaxFrameSize is the buffer size of the ZooKeeper client, which larger
+	// replies would not fit.
+	zkMaxFrameSize = 1536 * 1024
+)
+
+// zookeeperSaslClient returns a function creating the SASL client of each
+// ZooKeeper connection, or nil when ZookeeperSaslMechanism is not set.
+// ZooKeeper only authenticates, it has no security layer.
+func zookeeperSaslClient(configuration *ConnectionConfiguration) (func(host string) *sasl.Client, error) {
+	switch configuration.ZookeeperSaslMechanism {
+	case "":
+		return nil, nil
+	case "GSSAPI":
+		if err := checkKerberosProvider(configuration); err != nil {
+			return nil, err
+		}
+		return func(host string) *sasl.Client {
+			var mechanism *sasl.GSSAPIMechanism
+			if configuration.KerberosProvider == sasl.KERBEROS_PROVIDER_GOKRB5 {
+				mechanism = sasl.NewKerberosGSSAPIMechanism(ZOOKEEPER_SASL_SERVICE, sasl.KerberosSettings{
+					ConfigPath: configuration.KerberosConfigPath,
+					KeytabPath: configuration.KerberosKeytab,
+					CCachePath: configuration.KerberosCCache,
+					Principal:  configuration.KerberosClientPrincipal,
+				})
+			} else {
+				mechanism = sasl.NewGSSAPIMechanismForClient(ZOOKEEPER_SASL_SERVICE, configuration.KerberosClientPrincipal)
+			}
+			mechanism.Principal = configuration.ZookeeperPrincipal
+			mechanism.CanonicalizeHostName = configuration.CanonicalizeHostName
+			mechanism.UserSelectQop = sasl.QOP_TO_FLAG[sasl.AUTH]
+			return sasl.NewSaslClient(host, mechanism)
+		}, nil
+	case "DIGEST-MD5":
+		return func(string) *sasl.Client {
+			mechanism := sasl.NewDigestMD5Mechanism(ZOOKEEPER_SASL_SERVICE,
+				configuration.ZookeeperSaslUsername, configuration.ZookeeperSaslPassword)
+			mechanism.UserSelectQop = sasl.QOP_TO_FLAG[sasl.AUTH]
+			return sasl.NewSaslClient(zkDigestServerName, mechanism)
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported Zookeeper SASL mechanism %q", configuration.ZookeeperSaslMechanism)
+}
+
+// zkSaslDialer authenticates the connections of dial with the client of
+// newClient. Failed authentications are also sent to failed, as the ZooKeeper
+// client would otherwise keep retrying.
+func zkSaslDialer(dial DialContextFunc, newClient func(host string) *sasl.Client, failed chan<- error) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &zkSaslConn{Conn: conn, client: newClient(host), failed: failed}, nil
+	}
+}
+
+// zkSaslConn runs the SASL negotiation once the server has answered the
+// connect request, and only then hands the connect response to the ZooKeeper
+// client, which sends no request before it has one. The negotiation is bound
+// by the deadline the client sets for the response.
+type zkSaslConn struct {
+	net.Conn
+	client        *sasl.Client
+	failed        chan<- error
+	authenticated bool
+	// connectResponse is the frame not yet read by the ZooKeeper client.
+	connectResponse []byte
+}
+
+func (c *zkSaslConn) Read(p []byte) (int, error) {
+	if !c.authenticated {
+		c.authenticated = true
+		if err := c.authenticate(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.connectResponse) > 0 {
+		n := copy(p, c.connectResponse)
+		c.connectResponse = c.connectResponse[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *zkSaslConn) authenticate() error {
+	defer c.client.Dispose()
+	frame, err := readZkFrame(c.Conn)
+	if err != nil {
+		return err
+	}
+	c.connectResponse = frame
+	// The session ID follows the protocol version and timeout. The client
+	// handles expired sessions, which have none.
+	if len(frame) < 20 || binary.BigEndian.Uint64(frame[12:20]) == 0 {
+		return nil
+	}
+
+	token, err := c.client.Start()
+	for xid := int32(1); ; xid++ {
+		if err != nil {
+			return c.fail(err)
+		}
+		if c.client.Complete() && token == nil {
+			return nil
+		}
+		var challenge []byte
+		if challenge, err = c.exchange(xid, token); err != nil {
+			return err
+		}
+		if c.client.Complete() {
+			return nil
+		}
+		token, err = c.client.Step(challenge)
+	}
+}
+
+// exchange sends token in a SASL request and returns the token of the reply.
+func (c *zkSaslConn) exchange(xid int32, token []byte) ([]byte, error) {
+	request := make([]byte, 16+len(token))
+	binary.BigEndian.PutUint32(request, uint32(len(request)-4))
+	binary.BigEndian.PutUint32(request[4:], uint32(xid))
+	binary.BigEndian.PutUint32(request[8:], zkOpSasl)
+	binary.BigEndian.PutUint32(request[12:], uint32(len(token)))
+	copy(request[16:], token)
+	if _, err := c.Conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// The reply header is the xid, the zxid and the error code.
+	reply, err := readZkFrame(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	reply = reply[4:]
+	if len(reply) < 16 || int32(binary.BigEndian.Uint32(reply)) != xid {
+		return nil, errors.New("unexpected reply to a Zookeeper SASL request")
+	}
+	if code := int32(binary.BigEndian.Uint32(reply[12:])); code != 0 {
+		return nil, c.fail(errors.Errorf("the server rejected the credentials with error %d", code))
+	}
+	reply = reply[16:]
+	if len(reply) < 4 {
+		return nil, nil
+	}
+	size := int32(binary.BigEndian.Uint32(reply))
+	if size < 0 {
+		return nil, nil
+	}
+	if int(size) > len(reply)-4 {
+		return nil, errors.New("truncated Zookeeper SASL reply")
+	}
+	return reply[4 : 4+size], nil
+}
+
+func (c *zkSaslConn) fail(err error) error {
+	select {
+	case c.failed <- err:
+	default:
+	}
+	return err
+}
+
+// readZkFrame returns a length prefixed frame, including the length.
+func readZkFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(frame)
+	if size > zkMaxFrameSize {
+		return nil, errors.Errorf("Zookeeper frame of %d bytes exceeds the maximum of %d", size, zkMaxFrameSize)
+	}
+	frame = append(frame, make([]byte, size)...)
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,240 @@
+package hiveconnect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	sasl "github.com/Galzzly/hiveconnect/sasl"
+)
+
+const zkOpPing = 11
+
+// zkFrame prefixes the big-endian fields with their length. []byte fields are
+// written as is.
+func zkFrame(fields ...interface{}) []byte {
+	var body bytes.Buffer
+	for _, field := range fields {
+		if b, ok := field.([]byte); ok {
+			body.Write(b)
+			continue
+		}
+		binary.Write(&body, binary.BigEndian, field)
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(body.Len())), body.Bytes()...)
+}
+
+// fakeZookeeper answers the connect request with sessionID, then runs step for
+// every SASL request until it reports completion, and finally answers a ping.
+// SASL errors are replied with the AUTHFAILED code.
+func fakeZookeeper(conn net.Conn, sessionID int64, step func([]byte) ([]byte, bool, error)) error {
+	defer conn.Close()
+	if _, err := readZkFrame(conn); err != nil {
+		return err
+	}
+	passwd := make([]byte, 16)
+	if _, err := conn.Write(zkFrame(int32(0), int32(4000), sessionID, int32(len(passwd)), passwd)); err != nil {
+		return err
+	}
+
+	for done := sessionID == 0 || step == nil; ; {
+		frame, err := readZkFrame(conn)
+		if err != nil {
+			return err
+		}
+		xid := int32(binary.BigEndian.Uint32(frame[4:]))
+		opcode := int32(binary.BigEndian.Uint32(frame[8:]))
+		if done {
+			if opcode != zkOpPing {
+				return errors.New("unexpected request after authentication")
+			}
+			_, err = conn.Write(zkFrame(xid, int64(0), int32(0)))
+			return err
+		}
+		if opcode != zkOpSasl || int(binary.BigEndian.Uint32(frame[12:])) != len(frame)-16 {
+			return errors.New("malformed SASL request")
+		}
+		var challenge []byte
+		if challenge, done, err = step(frame[16:]); err != nil {
+			_, err = conn.Write(zkFrame(xid, int64(0), int32(-115)))
+			return err
+		}
+		if _, err = conn.Write(zkFrame(xid, int64(0), int32(0), int32(len(challenge)), challenge)); err != nil {
+			return err
+		}
+	}
+}
+
+// connectZookeeper drives conn like the ZooKeeper client, returning the
+// session ID.
+func connectZookeeper(conn net.Conn) (int64, error) {
+	if _, err := conn.Write(zkFrame(int32(0), int64(0), int32(4000), int64(0), int32(0))); err != nil {
+		return 0, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(zkFrame(int32(-2), int32(zkOpPing))); err != nil {
+		return 0, err
+	}
+	if _, err := readZkFrame(conn); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(response[8:])), nil
+}
+
+func dialFakeZookeeper(t *testing.T, sessionID int64, step func([]byte) ([]byte, bool, error),
+	newClient func(string) *sasl.Client, failed chan error) (net.Conn, chan error) {
+	t.Helper()
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- fakeZookeeper(server, sessionID, step) }()
+	dial := zkSaslDialer(func(context.Context, string, string) (net.Conn, error) {
+		return client, nil
+	}, newClient, failed)
+	conn, err := dial(context.Background(), "tcp", "zk1.example.com:2181")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, served
+}
+
+func TestZookeeperSaslDigestMD5(t *testing.T) {
+	configuration := NewConnectionConfiguration()
+	configuration.ZookeeperSaslMechanism = "DIGEST-MD5"
+	configuration.ZookeeperSaslUsername = "hive"
+	configuration.ZookeeperSaslPassword = "secret"
+	newClient, err := zookeeperSaslClient(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"secret", "wrong"} {
+		t.Run(password, func(t *testing.T) {
+			server := sasl.NewDigestMD5ServerMechanism(ZOOKEEPER_SASL_SERVICE, zkDigestServerName,
+				func(username, realm string) (string, error) {
+					if username != "hive" {
+						return "", errors.New("unknown user")
+					}
+					return password, nil
+				})
+			failed := make(chan error, 1)
+			conn, served := dialFakeZookeeper(t, 1, server.Step, newClient, failed)
+			sessionID, err := connectZookeeper(conn)
+			conn.Close()
+
+			if password == "wrong" {
+				if err == nil || !strings.Contains(err.Error(), "-115") {
+					t.Fatalf("expected the credentials to be rejected, got %v", err)
+				}
+				select {
+				case <-failed:
+				default:
+					t.Error("the failure was not reported")
+				}
+				return
+			}
+			if err != nil || sessionID != 1 {
+				t.Fatalf("session %d, %v", sessionID, err)
+			}
+			if err = <-served; err != nil {
+				t.Fatal(err)
+			}
+			if server.AuthorizationID() != "hive" {
+				t.Errorf("authenticated as %q", server.AuthorizationID())
+			}
+		})
+	}
+}
+
+func TestZookeeperSaslGSSAPI(t *testing.T) {
+	t.Setenv("SERVICE_HOST_QUALIFIED", "")
+	provider := &sasl.FakeGSSAPIProvider{}
+	newClient := func(host string) *sasl.Client {
+		mechanism := sasl.NewGSSAPIMechanismWithProvider(ZOOKEEPER_SASL_SERVICE, provider)
+		mechanism.UserSelectQop = sasl.QOP_TO_FLAG[sasl.AUTH]
+		return sasl.NewSaslClient(host, mechanism)
+	}
+
+	var tokens []string
+	step := func(token []byte) ([]byte, bool, error) {
+		tokens = append(tokens, string(token))
+		switch len(tokens) {
+		case 1:
+			return []byte("server-token"), false, nil
+		case 2:
+			return provider.SecurityLayerChallenge(sasl.QOP_TO_FLAG[sasl.AUTH], 65536), false, nil
+		}
+		return nil, true, nil
+	}
+	conn, served := dialFakeZookeeper(t, 1, step, newClient, nil)
+	if _, err := connectZookeeper(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 3 || tokens[0] != "fake-token-0" || tokens[1] != "" {
+		t.Fatalf("tokens %q", tokens)
+	}
+	if provider.Services[0] != "zookeeper/zk1.example.com" {
+		t.Errorf("service %q", provider.Services[0])
+	}
+	if !provider.Disposed {
+		t.Error("the mechanism was not disposed")
+	}
+}
+
+func TestZookeeperSaslExpiredSession(t *testing.T) {
+	newClient := func(host string) *sasl.Client {
+		return sasl.NewSaslClient(host, sasl.NewGSSAPIMechanismWithProvider(ZOOKEEPER_SASL_SERVICE,
+			&sasl.FakeGSSAPIProvider{InitErr: errors.New("unexpected negotiation")}))
+	}
+	conn, served := dialFakeZookeeper(t, 0, nil, newClient, nil)
+	if sessionID, err := connectZookeeper(conn); err != nil || sessionID != 0 {
+		t.Fatalf("session %d, %v", sessionID, err)
+	}
+	conn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZookeeperSaslClientConfiguration(t *testing.T) {
+	configuration := NewConnectionConfiguration()
+	if newClient, err := zookeeperSaslClient(configuration); newClient != nil || err != nil {
+		t.Errorf("SASL without a mechanism: %v", err)
+	}
+	configuration.ZookeeperSaslMechanism = "PLAIN"
+	if _, err := zookeeperSaslClient(configuration); err == nil {
+		t.Error("expected PLAIN to be rejected")
+	}
+	configuration.ZookeeperSaslMechanism = "GSSAPI"
+	configuration.KerberosKeytab = "/etc/security/keytabs/hive.keytab"
+	if _, err := zookeeperSaslClient(configuration); err == nil {
+		t.Error("expected the keytab to require the gokrb5 provider")
+	}
+}
+
+func TestReadZkFrameTooLarge(t *testing.T) {
+	frame := binary.BigEndian.AppendUint32(nil, zkMaxFrameSize+1)
+	if _, err := readZkFrame(bytes.NewReader(frame)); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected the frame to be rejected, got %v", err)
+	}
+	frame = zkFrame(make([]byte, zkMaxFrameSize))
+	if read, err := readZkFrame(bytes.NewReader(frame)); err != nil || len(read) != len(frame) {
+		t.Errorf("read %d bytes, %v", len(read), err)
+	}
+}